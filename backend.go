@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// fileScheme is the prefix of local directory targets.
+const fileScheme = "file://"
+
+var (
+	// errNotFound is returned by get for missing files.
+	errNotFound = errors.New("file not found")
+	// errPreconditionFailed is returned by create when its condition is not met.
+	errPreconditionFailed = errors.New("precondition failed")
+)
+
+// backend is a storage the files are uploaded to.
+type backend interface {
+	// put stores the file content along with its headers.
+	put(ctx context.Context, src *sourceFile) error
+	// update replaces the headers of an already stored file, leaving its content untouched.
+	update(ctx context.Context, src *sourceFile) error
+	// delete removes the given files, returning the ones that could not be removed.
+	delete(ctx context.Context, fnames []string) (failed []string, err error)
+	// list returns all the stored files whose key starts with prefix.
+	list(ctx context.Context, prefix string) ([]remoteFile, error)
+	// head returns the details of a stored file, including its headers and go3up hash.
+	head(ctx context.Context, fname string) (remoteFile, error)
+	// create stores data (as is, without headers) only if the file does not exist yet or, if etag is
+	// given, only if it is still stored with that etag. Otherwise it fails with errPreconditionFailed.
+	create(ctx context.Context, fname string, data []byte, etag string) error
+	// get returns the content of a stored file, along with its etag.
+	get(ctx context.Context, fname string) (data []byte, etag string, err error)
+	fmt.Stringer
+}
+
+// newBackend returns the backend for the given target: a local directory (file:///some/path)
+// or, if the target is blank, the S3 bucket.
+func newBackend(target string) (backend, error) {
+	switch {
+	case target == "":
+		return &s3Backend{bucket: opts.BucketName, svc: s3svc}, nil
+	case strings.HasPrefix(target, fileScheme) && len(target) > len(fileScheme):
+		return &fileBackend{root: strings.TrimPrefix(target, fileScheme)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported target %q, expected file:///some/path", target)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/alexaandru/utils"
+)
+
+// cacheSep separates the fields of a cache entry.
+const cacheSep = "+"
+
+// cacheEntry builds a cache entry out of a file content hash, its headers fingerprint and the
+// encoding its content is stored with (blank if stored as is).
+func cacheEntry(hash, fingerprint, encoding string) string {
+	entry := hash + cacheSep + fingerprint
+	if encoding != "" {
+		entry += cacheSep + encoding
+	}
+
+	return entry
+}
+
+// splitCacheEntry returns the content hash, headers fingerprint and content encoding of a cache
+// entry. Entries written by older versions (or built from the bucket contents) have a blank
+// fingerprint.
+func splitCacheEntry(entry string) (hash, fingerprint, encoding string) {
+	fields := append(strings.SplitN(entry, cacheSep, 3), "", "")
+
+	return fields[0], fields[1], fields[2]
+}
+
+// fingerprinted returns a copy of the current (content only) files hashes, suitable for caching,
+// with each entry also holding the fingerprint and content encoding the file is stored with (see
+// storedSourceFile).
+func fingerprinted(current, old utils.FileHashes) (out utils.FileHashes) {
+	out = utils.FileHashes{}
+	for fname, hash := range current {
+		sf := storedSourceFile(fname, hash, old[fname])
+		out[fname] = cacheEntry(hash, sf.fingerprint(), sf.hdrs[ContentEncoding])
+	}
+
+	return
+}
+
+// storedSourceFile returns the sourceFile of a key, as it is (to be) stored, given its content hash
+// and its old cache entry: when the compression thresholds are set (see skipCompression), files
+// whose compression does not pay off are stored as is. That is only evaluated for new or changed
+// files, the unchanged ones keep the decision recorded in their cache entry (a blank encoding), or
+// their rule encoding, for the entries without a fingerprint (see splitCacheEntry).
+func storedSourceFile(fname, hash, oldEntry string) (sf *sourceFile) {
+	sf = newSourceFile(fname)
+	if sf.encoding == "" || !compressionThresholds() {
+		return
+	}
+
+	oldHash, oldFingerprint, oldEncoding := splitCacheEntry(oldEntry)
+	if oldEntry != "" && oldHash == hash {
+		if oldFingerprint != "" && oldEncoding == "" {
+			sf.uncompress(sf.encoding + " skipped, as before")
+		}
+		return
+	}
+	if reason := sf.skipCompression(); reason != "" {
+		sf.uncompress(reason)
+	}
+
+	return
+}
+
+// cacheDiff compares the current files against the old list, returning the files that need to be
+// uploaded (diff) as well as the files that only need their headers updated (updates), as their
+// stored content is unchanged. A blank fingerprint in the old list is never considered a change,
+// so that caches written by older versions do not trigger a full upload.
+func cacheDiff(current, old utils.FileHashes) (diff, updates []string) {
+	diff, updates = []string{}, []string{}
+	for fname, hash := range current {
+		oldHash, oldFingerprint, oldEncoding := splitCacheEntry(old[fname])
+		if hash != oldHash {
+			diff = append(diff, fname)
+			continue
+		}
+
+		sf := storedSourceFile(fname, hash, old[fname])
+		if oldFingerprint == "" || oldFingerprint == sf.fingerprint() {
+			continue
+		}
+		if oldEncoding != sf.hdrs[ContentEncoding] {
+			diff = append(diff, fname)
+			continue
+		}
+		updates = append(updates, fname)
+	}
+
+	return
+}
+
+// dumpCache saves the cache to fname, atomically (see writeFileAtomic), in the same format as
+// utils.FileHashes.Dump (sorted, for stable diffs).
+func dumpCache(cache utils.FileHashes, fname string) error {
+	fnames := make([]string, 0, len(cache))
+	for fname := range cache {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+
+	return writeFileAtomic(fname, func(w io.Writer) (err error) {
+		for _, fname := range fnames {
+			if _, err = io.WriteString(w, fname+":"+cache[fname]+"\n"); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alexaandru/utils"
+)
+
+func TestSplitCacheEntry(t *testing.T) {
+	tests := map[string][3]string{
+		"01677e4c0ae5468b9b8b823487f14524+1a2b3c4d+gzip": {"01677e4c0ae5468b9b8b823487f14524", "1a2b3c4d", "gzip"},
+		"01677e4c0ae5468b9b8b823487f14524+1a2b3c4d":      {"01677e4c0ae5468b9b8b823487f14524", "1a2b3c4d", ""},
+		"01677e4c0ae5468b9b8b823487f14524":               {"01677e4c0ae5468b9b8b823487f14524", "", ""},
+		"":                                               {"", "", ""},
+	}
+
+	for entry, expected := range tests {
+		if hash, fp, enc := splitCacheEntry(entry); hash != expected[0] || fp != expected[1] || enc != expected[2] {
+			t.Errorf("Expected %q to split into %v, got %s, %s and %s", entry, expected, hash, fp, enc)
+		}
+	}
+
+	if hash, fp, enc := splitCacheEntry(cacheEntry("abc", "def", "gzip")); hash != "abc" || fp != "def" || enc != "gzip" {
+		t.Error("Expected cacheEntry and splitCacheEntry to round trip, got", hash, fp, enc)
+	}
+}
+
+func TestCacheDiff(t *testing.T) {
+	current := utils.FileHashes{
+		"foobar.html": "1", "barbaz.txt": "2", "new.txt": "3", "legacy.txt": "4", "index.html": "5", "changed.txt": "6",
+	}
+	old := utils.FileHashes{
+		"foobar.html": cacheEntry("1", newSourceFile("foobar.html").fingerprint(), "gzip"),
+		"barbaz.txt":  cacheEntry("2", "stale", ""),
+		"legacy.txt":  "4",
+		"index.html":  cacheEntry("5", "stale", ""),
+		"changed.txt": cacheEntry("0", newSourceFile("changed.txt").fingerprint(), ""),
+	}
+
+	diff, updates := cacheDiff(current, old)
+	sort.Strings(diff)
+	if actual := strings.Join(diff, ":"); actual != "changed.txt:index.html:new.txt" {
+		t.Error("Expected changed.txt (content), index.html (encoding) and new.txt (new) to be uploaded, got", actual)
+	}
+	if actual := strings.Join(updates, ":"); actual != "barbaz.txt" {
+		t.Error("Expected barbaz.txt (headers only) to be updated, got", actual)
+	}
+}
+
+func TestCacheDiffThresholds(t *testing.T) {
+	minSize := opts.CompressMinSize
+	defer func() { opts.CompressMinSize = minSize }()
+
+	current := utils.FileHashes{"foobar.html": "1"}
+	sf := newSourceFile("foobar.html")
+	sf.uncompress("")
+	old := utils.FileHashes{"foobar.html": cacheEntry("1", sf.fingerprint(), "")}
+
+	if diff, _ := cacheDiff(current, old); len(diff) != 1 {
+		t.Error("Expected the file stored as is to be compressed, without thresholds, got", diff)
+	}
+	opts.CompressMinSize = 1 << 20
+	if diff, updates := cacheDiff(current, old); len(diff)+len(updates) != 0 {
+		t.Error("Expected the file stored as is to be left alone, with thresholds, got", diff, updates)
+	}
+}
+
+func TestFingerprinted(t *testing.T) {
+	current := utils.FileHashes{"foobar.html": "1"}
+
+	out := fingerprinted(current, utils.FileHashes{})
+	if hash, fp, enc := splitCacheEntry(out["foobar.html"]); hash != "1" || fp != newSourceFile("foobar.html").fingerprint() || enc != "gzip" {
+		t.Error("Expected the entry to hold the hash, fingerprint and encoding, got", out)
+	}
+	if current["foobar.html"] != "1" {
+		t.Error("Expected the current list to be left untouched, got", current)
+	}
+}
+
+func TestDumpCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the temp folder:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, ".go3up.txt")
+	cache := utils.FileHashes{"b.html": "2+fp", "a.html": "1+fp+gzip"}
+	if err = dumpCache(cache, fname); err != nil {
+		t.Fatal("Expected the cache to be saved, got", err)
+	}
+	if data, _ := ioutil.ReadFile(fname); string(data) != "a.html:1+fp+gzip\nb.html:2+fp\n" {
+		t.Errorf("Expected the cache to be saved sorted, got %q", data)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Mode().Perm() != defaultFileMode {
+		t.Errorf("Expected the cache to be saved with mode %v, got %v (%v)", defaultFileMode, fi, err)
+	}
+}
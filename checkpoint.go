@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alexaandru/utils"
+)
+
+// checkpoint keeps track of the work completed so far and periodically saves it to the cache file,
+// every so many completed files or every so often, so that an interrupted (or crashed) run resumes
+// where it left off, rather than starting over.
+type checkpoint struct {
+	fname    string
+	cache    utils.FileHashes // the cache, as of the work completed so far.
+	entries  utils.FileHashes // the cache entries of the files, once uploaded.
+	every    int
+	interval time.Duration
+	pending  int
+	last     time.Time
+	sync.Mutex
+}
+
+// newCheckpoint returns a checkpoint for the given work, starting from a cache where none of it
+// is completed: the files to be uploaded, updated or deleted keep their old entries (if any).
+func newCheckpoint(fname string, current, old utils.FileHashes, work []*sourceFile, every int, interval time.Duration) (c *checkpoint) {
+	c = &checkpoint{
+		fname:    fname,
+		cache:    fingerprinted(current, old),
+		entries:  utils.FileHashes{},
+		every:    every,
+		interval: interval,
+		last:     time.Now(),
+	}
+	for _, src := range work {
+		for _, fname := range src.keys() {
+			if entry, ok := c.cache[fname]; ok {
+				c.entries[fname] = entry
+			}
+			if hash, ok := old[fname]; ok {
+				c.cache[fname] = hash
+			} else {
+				delete(c.cache, fname)
+			}
+		}
+	}
+
+	return
+}
+
+// done records the src work as completed, saving the cache if it is time for it. It is a no-op
+// on a nil checkpoint.
+func (c *checkpoint) done(src *sourceFile) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, fname := range src.keys() {
+		if src.action == actionDelete {
+			delete(c.cache, fname)
+		} else {
+			c.cache[fname] = c.entries[fname]
+		}
+	}
+
+	c.pending++
+	if (c.every > 0 && c.pending >= c.every) || (c.interval > 0 && time.Since(c.last) >= c.interval) {
+		if err := c.flush(); err != nil {
+			logger.Warn("Checkpointing cache failed", "error", err, progress("!"))
+		}
+	}
+}
+
+// flush saves the cache. It must be called with the lock held.
+func (c *checkpoint) flush() (err error) {
+	if err = dumpCache(c.cache, c.fname); err != nil {
+		return
+	}
+	c.pending, c.last = 0, time.Now()
+
+	return
+}
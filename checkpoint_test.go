@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alexaandru/utils"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the temp folder:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "cache.txt")
+	current := utils.FileHashes{"foobar.html": "1", "barbaz.txt": "2"}
+	old := utils.FileHashes{"foobar.html": "0", "old.txt": "3"}
+	work := workList(current, utils.FileHashes{}, []string{"foobar.html", "barbaz.txt"}, nil, [][]string{{"old.txt"}})
+	entries := fingerprinted(current, utils.FileHashes{})
+
+	c := newCheckpoint(fname, current, old, work, 2, 0)
+	if len(c.cache) != 2 || c.cache["foobar.html"] != "0" || c.cache["old.txt"] != "3" {
+		t.Fatal("Expected the checkpoint to start with none of the work completed, got", c.cache)
+	}
+
+	c.done(work[0])
+	if _, err = os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatal("Expected the cache not to be saved before enough files completed, got", err)
+	}
+
+	c.done(work[2])
+	cache := utils.FileHashes{}
+	cache.Load(fname)
+	if len(cache) != 2 || cache["barbaz.txt"] != entries["barbaz.txt"] || cache["foobar.html"] != "0" {
+		t.Error("Expected the completed work to be saved, got", cache)
+	}
+
+	c.done(work[1])
+	if c.pending != 1 || c.cache["foobar.html"] != entries["foobar.html"] {
+		t.Error("Expected the completed work to be recorded, got", c.pending, c.cache)
+	}
+
+	var nilCheckpoint *checkpoint
+	nilCheckpoint.done(work[0])
+}
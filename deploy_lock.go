@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// deployLockKey is the key of the deploy lock, at the root of the bucket.
+const deployLockKey = ".go3up.lock"
+
+// how often to check whether a (live) deploy lock got released, while waiting for it.
+var deployLockPoll = 5 * time.Second
+
+// deployLock is the content of the deploy lock, which guards the bucket against concurrent deploys.
+type deployLock struct {
+	Holder  string
+	Host    string
+	PID     int
+	Started time.Time
+	TTL     int // seconds
+}
+
+// lockedError is returned by acquireDeployLock when the lock is held by another (live) deploy.
+type lockedError struct {
+	held deployLock
+}
+
+func (e lockedError) Error() string {
+	return fmt.Sprintf("the bucket is locked by %s on %s (pid %d) since %s, until %s",
+		e.held.Holder, e.held.Host, e.held.PID, e.held.Started.Format(time.RFC3339), e.held.expires().Format(time.RFC3339))
+}
+
+// newDeployLock returns a deploy lock held by the current process.
+func newDeployLock(holder string, ttl int) (l deployLock) {
+	host, _ := os.Hostname()
+	if holder == "" {
+		holder = os.Getenv("USER")
+	}
+
+	return deployLock{Holder: holder, Host: host, PID: os.Getpid(), Started: time.Now().UTC(), TTL: ttl}
+}
+
+func (l deployLock) expires() time.Time {
+	return l.Started.Add(time.Duration(l.TTL) * time.Second)
+}
+
+// acquireDeployLock writes the l lock to the b backend, unless a live lock already exists, in which
+// case it waits for it to be released (or to expire), for up to wait, before giving up with a
+// lockedError. Expired locks are taken over. The returned func releases the lock.
+func acquireDeployLock(ctx context.Context, b backend, l deployLock, wait time.Duration) (release func(), err error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		if err = b.create(ctx, deployLockKey, data, ""); err != errPreconditionFailed {
+			break
+		}
+
+		held, etag, err2 := b.get(ctx, deployLockKey)
+		if err2 == errNotFound {
+			continue
+		} else if err2 != nil {
+			return nil, err2
+		}
+
+		other := deployLock{}
+		if err = json.Unmarshal(held, &other); err != nil || time.Now().After(other.expires()) {
+			if err = b.create(ctx, deployLockKey, data, etag); err != errPreconditionFailed {
+				break
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, lockedError{other}
+		}
+		logger.Info("Waiting for the deploy lock", "holder", other.Holder, "host", other.Host, "expires", other.expires(), progress("w"))
+		select {
+		case <-time.After(deployLockPoll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	return func() {
+		releaseDeployLock(b, data)
+	}, nil
+}
+
+// releaseDeployLock removes the deploy lock, as long as it is still the one holding data (it may
+// have expired and been taken over in the meantime).
+func releaseDeployLock(b backend, data []byte) {
+	ctx := context.Background()
+	if held, _, err := b.get(ctx, deployLockKey); err != nil || !bytes.Equal(held, data) {
+		return
+	}
+	if _, err := b.delete(ctx, []string{deployLockKey}); err != nil {
+		logger.Warn("Failed to release the deploy lock", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAcquireDeployLock(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	release, err := acquireDeployLock(ctx, b, newDeployLock("ci", 60), 0)
+	if err != nil {
+		t.Fatal("Expected the lock to be acquired, got", err)
+	}
+
+	data, _, err := b.get(ctx, deployLockKey)
+	held := deployLock{}
+	if err != nil || json.Unmarshal(data, &held) != nil || held.Holder != "ci" || held.TTL != 60 || held.Host == "" {
+		t.Error("Expected the lock to be stored, got", string(data), err)
+	}
+
+	if _, err = acquireDeployLock(ctx, b, newDeployLock("other", 60), 0); err == nil {
+		t.Fatal("Expected the lock to be refused while held")
+	} else if e, ok := err.(lockedError); !ok || e.held.Holder != "ci" {
+		t.Error("Expected a lockedError naming the holder, got", err)
+	}
+
+	release()
+	if _, _, err = b.get(ctx, deployLockKey); err != errNotFound {
+		t.Fatal("Expected the lock to be released, got", err)
+	}
+
+	stale := newDeployLock("crashed", 60)
+	stale.Started = stale.Started.Add(-time.Hour)
+	data, _ = json.Marshal(stale)
+	if err = b.create(ctx, deployLockKey, data, ""); err != nil {
+		t.Fatal("Failed to store a stale lock:", err)
+	}
+	if release, err = acquireDeployLock(ctx, b, newDeployLock("ci", 60), 0); err != nil {
+		t.Fatal("Expected a stale lock to be taken over, got", err)
+	}
+
+	// Someone else took the lock over (i.e. after it expired): it must be left alone.
+	data2, etag, _ := b.get(ctx, deployLockKey)
+	if err = b.create(ctx, deployLockKey, data, etag); err != nil {
+		t.Fatal("Failed to take the lock over:", err)
+	}
+	release()
+	if data2, _, _ = b.get(ctx, deployLockKey); string(data2) != string(data) {
+		t.Error("Expected someone else's lock not to be released, got", string(data2))
+	}
+}
+
+func TestAcquireDeployLockWait(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	poll := deployLockPoll
+	deployLockPoll = time.Millisecond
+	defer func() {
+		deployLockPoll = poll
+	}()
+
+	ctx := context.Background()
+	held, err := acquireDeployLock(ctx, b, newDeployLock("ci", 60), 0)
+	if err != nil {
+		t.Fatal("Expected the lock to be acquired, got", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		held()
+	}()
+
+	release, err := acquireDeployLock(ctx, b, newDeployLock("other", 60), time.Minute)
+	if err != nil {
+		t.Fatal("Expected the lock to be acquired once released, got", err)
+	}
+	release()
+
+	cancelled, cancel := context.WithCancel(ctx)
+	release, _ = acquireDeployLock(ctx, b, newDeployLock("ci", 60), 0)
+	defer release()
+	cancel()
+	if _, err = acquireDeployLock(cancelled, b, newDeployLock("other", 60), time.Minute); err != context.Canceled {
+		t.Error("Expected waiting to stop once cancelled, got", err)
+	}
+}
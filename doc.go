@@ -11,7 +11,7 @@ switching from s3cmd to go3up was significant.
 
 On uploads with empty cache there may not be any benefit.
 
-The current focus of the tool is just one way/uploads (without deleting things that were removed
-locally, yet). That may (or not) change in the future.
+The current focus of the tool is just one way/uploads. Files that were removed locally can
+optionally be deleted from the bucket too (see the "-delete" flag).
 */
 package main
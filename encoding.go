@@ -0,0 +1,170 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// identity is the Content-Encoding of the content stored as is (same as no Content-Encoding).
+const identity = "identity"
+
+// defaultLevel stands for the default compression level of each encoding.
+const defaultLevel = 0
+
+// encoding is a supported Content-Encoding: how to compress content with it, the range of
+// compression levels it accepts (besides defaultLevel) and the file extension of its variants.
+type encoding struct {
+	newWriter          func(w io.Writer, level int) (io.WriteCloser, error)
+	minLevel, maxLevel int
+	ext                string
+}
+
+// supported Content-Encodings, besides identity.
+var encodings = map[string]encoding{
+	"gzip": {func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == defaultLevel {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}, gzip.BestSpeed, gzip.BestCompression, ".gz"},
+	"br": {func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == defaultLevel {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	}, 1, brotli.BestCompression, ".br"},
+	"zstd": {func(w io.Writer, level int) (io.WriteCloser, error) {
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != defaultLevel {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}, 1, 22, ".zst"},
+}
+
+// validateEncoding checks that the Content-Encoding is supported, along with the compression level.
+func validateEncoding(name string, level int) error {
+	if name == "" || name == identity {
+		if level != defaultLevel {
+			return fmt.Errorf("compression level %d given without a content encoding", level)
+		}
+		return nil
+	}
+
+	enc, ok := encodings[name]
+	if !ok {
+		return fmt.Errorf("unsupported content encoding %q", name)
+	}
+	if level != defaultLevel && (level < enc.minLevel || level > enc.maxLevel) {
+		return fmt.Errorf("compression level %d out of the %d-%d range of %s", level, enc.minLevel, enc.maxLevel, name)
+	}
+
+	return nil
+}
+
+// compressionSample is how much of a file gets compressed for estimating the compression savings.
+const compressionSample = 64 * 1024
+
+// compressionChecks memoizes the outcome of skipCompression, as the source file of each key is
+// built several times during a run.
+var compressionChecks = struct {
+	m map[string]compressionCheck
+	sync.Mutex
+}{m: map[string]compressionCheck{}}
+
+// compressionCheck is the outcome of skipCompression, for a given version of a file.
+type compressionCheck struct {
+	size    int64
+	modTime time.Time
+	reason  string
+}
+
+// compressionThresholds tells whether any of the -compress-min-size and -compress-min-savings
+// options is set.
+func compressionThresholds() bool {
+	return opts.CompressMinSize > 0 || opts.CompressMinSavings > 0
+}
+
+// skipCompression tells whether compressing the file does not pay off, as per the -compress-min-size
+// and -compress-min-savings options, returning the reason if so. The savings are estimated out of
+// its first compressionSample bytes (or out of its precompressed sibling size, if any). Files that
+// cannot be read are compressed as usual (and fail to upload, later on). It is only meant for the
+// files to be uploaded (see storedSourceFile), as it is costly.
+func (s *sourceFile) skipCompression() (reason string) {
+	if s.encoding == "" || !compressionThresholds() {
+		return
+	}
+
+	fi, err := os.Stat(s.fpath)
+	if err != nil {
+		return
+	}
+	key := fmt.Sprintf("%s|%s|%d|%s|%d|%d", s.fpath, s.encoding, s.level, s.precompressed, opts.CompressMinSize, opts.CompressMinSavings)
+
+	compressionChecks.Lock()
+	check, ok := compressionChecks.m[key]
+	compressionChecks.Unlock()
+	if ok && check.size == fi.Size() && check.modTime.Equal(fi.ModTime()) {
+		return check.reason
+	}
+
+	if fi.Size() < opts.CompressMinSize {
+		reason = fmt.Sprintf("%s skipped: %d bytes, under the %d bytes minimum", s.encoding, fi.Size(), opts.CompressMinSize)
+	} else if opts.CompressMinSavings > 0 {
+		original, compressed, err := s.compressionSample()
+		if err != nil {
+			return
+		}
+		if savings := 100 - percent(compressed, original); savings < opts.CompressMinSavings {
+			reason = fmt.Sprintf("%s skipped: saves %d%%, under the %d%% minimum", s.encoding, savings, opts.CompressMinSavings)
+		}
+	}
+
+	compressionChecks.Lock()
+	compressionChecks.m[key] = compressionCheck{fi.Size(), fi.ModTime(), reason}
+	compressionChecks.Unlock()
+
+	return
+}
+
+// compressionSample returns the size of the sample of the file content and its compressed size.
+func (s *sourceFile) compressionSample() (original, compressed int64, err error) {
+	if s.precompressed != "" {
+		fi, err := os.Stat(s.fpath)
+		if err != nil {
+			return 0, 0, err
+		}
+		sibling, err := os.Stat(s.precompressed)
+		if err != nil {
+			return 0, 0, err
+		}
+		return fi.Size(), sibling.Size(), nil
+	}
+
+	f, err := os.Open(s.fpath)
+	if err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	w := countingWriter{}
+	wz, err := encodings[s.encoding].newWriter(&w, s.level)
+	if err != nil {
+		return
+	}
+	if original, err = io.Copy(wz, io.LimitReader(f, compressionSample)); err != nil {
+		return
+	}
+	if err = wz.Close(); err != nil {
+		return
+	}
+
+	return original, w.n, nil
+}
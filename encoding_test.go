@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestEncodings(t *testing.T) {
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	original, err := ioutil.ReadFile("test/output/foobar.html")
+	if err != nil {
+		t.Fatal("Failed to read foobar.html:", err)
+	}
+	for name, decoder := range decoders {
+		for _, level := range []int{defaultLevel, encodings[name].maxLevel} {
+			sf := newSourceFile("foobar.html")
+			sf.encoding, sf.level = name, level
+			body, err := sf.body()
+			if err != nil {
+				t.Fatal("Expected body to succeed, got", err)
+			}
+			compressed, err := ioutil.ReadAll(body)
+			_ = body.Close()
+			if err != nil {
+				t.Fatalf("Expected %s (level %d) compression to succeed, got %v", name, level, err)
+			}
+
+			r, err := decoder(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("Expected the content to be %s compressed, got %v", name, err)
+			}
+			if content, _ := ioutil.ReadAll(r); !bytes.Equal(content, original) {
+				t.Errorf("Expected the %s (level %d) content to round trip, got %q", name, level, content)
+			}
+		}
+	}
+}
+
+func TestValidateEncoding(t *testing.T) {
+	valid := map[string]int{"": defaultLevel, identity: defaultLevel, "gzip": 9, "br": 11, "zstd": defaultLevel}
+	for name, level := range valid {
+		if err := validateEncoding(name, level); err != nil {
+			t.Errorf("Expected %s level %d to be valid, got %v", name, level, err)
+		}
+	}
+
+	invalid := map[string]int{"": 1, "deflate": defaultLevel, "gzip": 10, "br": -1}
+	for name, level := range invalid {
+		if err := validateEncoding(name, level); err == nil {
+			t.Errorf("Expected %s level %d to be invalid", name, level)
+		}
+	}
+}
+
+func TestSkipCompression(t *testing.T) {
+	source, minSize, minSavings := opts.Source, opts.CompressMinSize, opts.CompressMinSavings
+	defer func() { opts.Source, opts.CompressMinSize, opts.CompressMinSavings = source, minSize, minSavings }()
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	files := map[string][]byte{
+		"tiny.js":   []byte("tiny"),
+		"random.js": random,
+		"text.js":   []byte(strings.Repeat("go3up ", 1000)),
+	}
+	opts.Source = t.TempDir()
+	for fname, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(opts.Source, fname), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for fname := range files {
+		if sf := storedSourceFile(fname, "new", ""); sf.uncompressed != "" || sf.encoding != "gzip" {
+			t.Errorf("Expected %s to be compressed without thresholds, got %q", fname, sf.uncompressed)
+		}
+	}
+
+	opts.CompressMinSize, opts.CompressMinSavings = 100, 20
+	tests := map[string]string{
+		"tiny.js":   "gzip skipped: 4 bytes, under the 100 bytes minimum",
+		"random.js": "under the 20% minimum",
+		"text.js":   "",
+	}
+	for fname, expected := range tests {
+		sf := storedSourceFile(fname, "new", "")
+		if expected == "" && (sf.uncompressed != "" || sf.hdrs[ContentEncoding] != "gzip") {
+			t.Errorf("Expected %s to be compressed, got %q", fname, sf.uncompressed)
+		} else if expected != "" && (!strings.Contains(sf.uncompressed, expected) || sf.encoding != "" || sf.hdrs[ContentEncoding] != "") {
+			t.Errorf("Expected %s to be uploaded uncompressed (%q), got %q %v", fname, expected, sf.uncompressed, sf.hdrs)
+		}
+	}
+
+	// Unchanged files keep the decision recorded in the cache, without it being evaluated again.
+	fp := newSourceFile("tiny.js").fingerprint()
+	if sf := storedSourceFile("tiny.js", "old", cacheEntry("old", fp, "gzip")); sf.uncompressed != "" || sf.encoding != "gzip" {
+		t.Error("Expected the cached decision (compressed) to be kept, got", sf.uncompressed)
+	}
+	if sf := storedSourceFile("text.js", "old", cacheEntry("old", fp, "")); sf.uncompressed == "" || sf.encoding != "" {
+		t.Error("Expected the cached decision (uncompressed) to be kept, got", sf.hdrs)
+	}
+	if sf := storedSourceFile("tiny.js", "new", cacheEntry("old", fp, "gzip")); sf.uncompressed == "" {
+		t.Error("Expected the decision to be evaluated for changed files, got", sf.hdrs)
+	}
+	// Legacy entries have no fingerprint: the file was stored with its rule encoding.
+	if sf := storedSourceFile("tiny.js", "old", "old"); sf.uncompressed != "" || sf.encoding != "gzip" {
+		t.Error("Expected the rule encoding to be kept for legacy entries, got", sf.uncompressed)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(opts.Source, "tiny.js"), files["text.js"], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sf := storedSourceFile("tiny.js", "newer", ""); sf.uncompressed != "" {
+		t.Error("Expected the decision to follow the file changes, got", sf.uncompressed)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestFileBackend(t *testing.T) (b *fileBackend, cleanup func()) {
+	root, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the target folder:", err)
+	}
+
+	return &fileBackend{root: root}, func() { _ = os.RemoveAll(root) }
+}
+
+func TestNewBackend(t *testing.T) {
+	if b, err := newBackend(""); err != nil || b.String() != opts.BucketName {
+		t.Error("Expected a blank target to select the bucket, got", b, err)
+	}
+
+	if b, err := newBackend("file:///srv/www"); err != nil || b.(*fileBackend).root != "/srv/www" {
+		t.Error("Expected a file target to select the local folder, got", b, err)
+	}
+
+	for _, target := range []string{"file://", "ftp://example.com", "/srv/www"} {
+		if _, err := newBackend(target); err == nil {
+			t.Errorf("Expected %s to be an invalid target", target)
+		}
+	}
+}
+
+func TestFileBackendPut(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	sf := newSourceFile("foobar.html")
+	sf.hash = "01677e4c0ae5468b9b8b823487f14524"
+	if err := b.put(context.Background(), sf); err != nil {
+		t.Fatal("Expected put to succeed, got", err)
+	}
+
+	f, err := os.Open(filepath.Join(b.root, "foobar.html"))
+	if err != nil {
+		t.Fatal("Expected foobar.html to be stored, got", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal("Expected foobar.html to be stored gzipped, got", err)
+	}
+	content, _ := ioutil.ReadAll(zr)
+	original, _ := ioutil.ReadFile(sf.fpath)
+	if string(content) != string(original) {
+		t.Errorf("Expected stored content to be %q got %q", original, content)
+	}
+
+	r, err := b.head(context.Background(), "foobar.html")
+	if err != nil {
+		t.Fatal("Expected head to succeed, got", err)
+	}
+	if r.hash != sf.hash || !r.hdrs.equal(sf.hdrs) {
+		t.Errorf("Expected the sidecar to hold %s and %v, got %v", sf.hash, sf.hdrs, r)
+	}
+
+	for _, fname := range []string{"foobar.html", "foobar.html" + sidecarExt} {
+		if fi, err := os.Stat(filepath.Join(b.root, fname)); err != nil || fi.Mode().Perm() != defaultFileMode {
+			t.Errorf("Expected %s to be readable by all, got %v (%v)", fname, fi, err)
+		}
+	}
+}
+
+func TestFileBackendUpdate(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	sf := newSourceFile("barbaz.txt")
+	if err := b.update(context.Background(), sf); err == nil {
+		t.Error("Expected updating a missing file to fail")
+	}
+
+	if err := b.put(context.Background(), sf); err != nil {
+		t.Fatal("Expected put to succeed, got", err)
+	}
+	sf.hdrs[CacheControl] = "no-cache"
+	if err := b.update(context.Background(), sf); err != nil {
+		t.Fatal("Expected update to succeed, got", err)
+	}
+	etag, _ := md5File(sf.fpath)
+	if r, _ := b.head(context.Background(), "barbaz.txt"); r.hdrs[CacheControl] != "no-cache" || r.etag != etag {
+		t.Error("Expected headers to be updated and content left untouched, got", r)
+	}
+}
+
+func TestFileBackendListDelete(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	if objects, err := (&fileBackend{root: filepath.Join(b.root, "missing")}).list(context.Background(), ""); err != nil || len(objects) != 0 {
+		t.Error("Expected a missing root to be listed as empty, got", objects, err)
+	}
+
+	for _, fname := range []string{"foobar.html", "barbaz.txt"} {
+		sf := newSourceFile(fname)
+		sf.fname = "sub/" + fname
+		if err := b.put(context.Background(), sf); err != nil {
+			t.Fatal("Expected put to succeed, got", err)
+		}
+	}
+
+	objects, err := b.list(context.Background(), "")
+	if err != nil {
+		t.Fatal("Expected list to succeed, got", err)
+	}
+	keys := []string{}
+	for _, obj := range objects {
+		keys = append(keys, obj.key)
+	}
+	sort.Strings(keys)
+	if actual := strings.Join(keys, ":"); actual != "sub/barbaz.txt:sub/foobar.html" {
+		t.Error("Expected the stored files (without sidecars) to be listed, got", actual)
+	}
+
+	if objects, _ = b.list(context.Background(), "sub/foo"); len(objects) != 1 || objects[0].key != "sub/foobar.html" {
+		t.Error("Expected the listing to be restricted to the prefix, got", objects)
+	}
+
+	failed, err := b.delete(context.Background(), []string{"sub/foobar.html", "sub/missing.html"})
+	if err != nil || len(failed) != 0 {
+		t.Fatal("Expected delete to succeed, got", failed, err)
+	}
+	if _, err = os.Stat(filepath.Join(b.root, "sub", "foobar.html"+sidecarExt)); !os.IsNotExist(err) {
+		t.Error("Expected the sidecar to be deleted too, got", err)
+	}
+	if objects, _ = b.list(context.Background(), ""); len(objects) != 1 || objects[0].key != "sub/barbaz.txt" {
+		t.Error("Expected only sub/barbaz.txt to be left, got", objects)
+	}
+}
+
+func TestFileBackendCreate(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	testBackendCreate(t, b, "sub/lock")
+}
+
+// testBackendCreate exercises the create and get calls of a backend, on the fname file.
+func testBackendCreate(t *testing.T, b backend, fname string) {
+	ctx := context.Background()
+	defer func() {
+		_, _ = b.delete(ctx, []string{fname})
+	}()
+
+	if _, _, err := b.get(ctx, fname); err != errNotFound {
+		t.Fatal("Expected the file not to be found, got", err)
+	}
+	if err := b.create(ctx, fname, []byte("one"), ""); err != nil {
+		t.Fatal("Expected create to succeed, got", err)
+	}
+	if err := b.create(ctx, fname, []byte("two"), ""); err != errPreconditionFailed {
+		t.Fatal("Expected create to fail for an existing file, got", err)
+	}
+
+	data, etag, err := b.get(ctx, fname)
+	if err != nil || string(data) != "one" {
+		t.Fatal("Expected get to return the content, got", string(data), err)
+	}
+	if err = b.create(ctx, fname, []byte("two"), "0123456789abcdef0123456789abcdef"); err != errPreconditionFailed {
+		t.Fatal("Expected create to fail for a mismatching etag, got", err)
+	}
+	if err = b.create(ctx, fname, []byte("two"), etag); err != nil {
+		t.Fatal("Expected create to succeed for a matching etag, got", err)
+	}
+	if data, _, _ = b.get(ctx, fname); string(data) != "two" {
+		t.Error("Expected the content to be replaced, got", string(data))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFile is the name of the (gitignore style) file listing the files to be skipped,
+// read from the root of each source folder.
+const ignoreFile = ".go3upignore"
+
+// filterRule is a compiled gitignore style pattern.
+type filterRule struct {
+	re              *regexp.Regexp
+	negate, dirOnly bool
+}
+
+// fileFilter decides which of the local files are to be considered at all.
+type fileFilter struct {
+	include, exclude []filterRule
+}
+
+// newFilterRule compiles a gitignore style pattern: "*" and "?" do not match "/", "**" matches
+// any number of folders, a leading "!" negates the pattern and a trailing "/" restricts it to
+// folders. Patterns holding a "/" are relative to the source root, the others match at any level.
+func newFilterRule(pattern string) (rule filterRule, err error) {
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		rule.negate, p = true, p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly, p = true, strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return rule, fmt.Errorf("invalid pattern %q", pattern)
+	}
+
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	re := &strings.Builder{}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(p[i:], ']')
+			if j < 0 {
+				return rule, fmt.Errorf("invalid pattern %q: unterminated [", pattern)
+			}
+			class := p[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += j
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	prefix := "(^|/)"
+	if anchored {
+		prefix = "^"
+	}
+	if rule.re, err = regexp.Compile(prefix + re.String() + "$"); err != nil {
+		return rule, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+
+	return
+}
+
+func (r filterRule) match(rel string, dir bool) bool {
+	return (dir || !r.dirOnly) && r.re.MatchString(rel)
+}
+
+func compileFilterRules(patterns []string) (rules []filterRule, err error) {
+	for _, pattern := range patterns {
+		rule, err := newFilterRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return
+}
+
+// newFileFilter builds the filter for the files in the root folder, out of the include and exclude
+// patterns as well as the patterns found in the root .go3upignore file (if any), which are
+// considered exclude patterns.
+func newFileFilter(root string, include, exclude []string) (f *fileFilter, err error) {
+	ignored, err := readIgnoreFile(filepath.Join(root, ignoreFile))
+	if err != nil {
+		return
+	}
+
+	f = &fileFilter{}
+	if f.include, err = compileFilterRules(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compileFilterRules(append(append([]string{}, exclude...), ignored...)); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// readIgnoreFile returns the patterns in an ignore file, skipping blank lines and comments.
+// A missing file holds no patterns.
+func readIgnoreFile(fname string) (patterns []string, err error) {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return
+}
+
+// skip tells if the file (or folder) with the given path, relative to the root, is to be skipped.
+// As with gitignore, the last matching exclude pattern wins and the files in a skipped folder are
+// skipped too. When include patterns are given, only the files matching them (or living in a
+// folder matching them) are kept.
+func (f *fileFilter) skip(rel string, dir bool) bool {
+	rel = filepath.ToSlash(rel)
+	if rel == ignoreFile {
+		return true
+	}
+
+	for _, parent := range parents(rel) {
+		if lastMatch(f.exclude, parent, true) {
+			return true
+		}
+	}
+	if excluded := lastMatch(f.exclude, rel, dir); excluded || dir || len(f.include) == 0 {
+		return excluded
+	}
+
+	included := false
+	for _, rule := range f.include {
+		matched := rule.match(rel, false)
+		for _, parent := range parents(rel) {
+			matched = matched || rule.match(parent, true)
+		}
+		if matched {
+			included = !rule.negate
+		}
+	}
+
+	return !included
+}
+
+// lastMatch tells if the last of the rules matching rel is a positive one.
+func lastMatch(rules []filterRule, rel string, dir bool) (matched bool) {
+	for _, rule := range rules {
+		if rule.match(rel, dir) {
+			matched = !rule.negate
+		}
+	}
+
+	return
+}
+
+// parents returns the parent folders of a (slash separated) path, outermost first.
+func parents(rel string) (out []string) {
+	for i, c := range rel {
+		if c == '/' {
+			out = append(out, rel[:i])
+		}
+	}
+
+	return
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alexaandru/utils"
+)
+
+func TestNewFilterRule(t *testing.T) {
+	tests := []struct {
+		pattern, rel string
+		dir, match   bool
+	}{
+		{"*.swp", "a.swp", false, true},
+		{"*.swp", "deep/down/.a.swp", false, true},
+		{".DS_Store", "img/.DS_Store", false, true},
+		{"*.html", "a/b.htmlx", false, false},
+		{"/*.html", "index.html", false, true},
+		{"/*.html", "docs/index.html", false, false},
+		{"docs/*.html", "docs/index.html", false, true},
+		{"docs/*.html", "docs/v2/index.html", false, false},
+		{"docs/**/*.html", "docs/index.html", false, true},
+		{"docs/**/*.html", "docs/v2/x/index.html", false, true},
+		{"**/tmp", "a/b/tmp", true, true},
+		{"docs/**", "docs/a/b.txt", false, true},
+		{".git/", ".git", true, true},
+		{".git/", ".git", false, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file[0-9].txt", "file1.txt", false, true},
+		{"file[!0-9].txt", "file1.txt", false, false},
+		{"a+b.txt", "a+b.txt", false, true},
+	}
+
+	for _, tc := range tests {
+		rule, err := newFilterRule(tc.pattern)
+		if err != nil {
+			t.Errorf("Expected %q to compile, got %v", tc.pattern, err)
+			continue
+		}
+		if actual := rule.match(tc.rel, tc.dir); actual != tc.match {
+			t.Errorf("Expected %q matching %q (dir: %v) to be %v", tc.pattern, tc.rel, tc.dir, tc.match)
+		}
+	}
+
+	for _, pattern := range []string{"", "!", "/", "file[0-9.txt"} {
+		if _, err := newFilterRule(pattern); err == nil {
+			t.Errorf("Expected %q to be an invalid pattern", pattern)
+		}
+	}
+}
+
+func TestFileFilterSkip(t *testing.T) {
+	f := &fileFilter{}
+	f.include, _ = compileFilterRules([]string{"*.html", "assets/", "!assets/*.map"})
+	f.exclude, _ = compileFilterRules([]string{"drafts/", "*.tmp.html", "!keep.tmp.html"})
+
+	tests := map[string]bool{
+		"index.html":        false,
+		"drafts/index.html": true,
+		"a.tmp.html":        true,
+		"keep.tmp.html":     false,
+		"readme.txt":        true,
+		"assets/app.js":     false,
+		"assets/app.js.map": true,
+		ignoreFile:          true,
+	}
+	for rel, expected := range tests {
+		if actual := f.skip(rel, false); actual != expected {
+			t.Errorf("Expected skip(%s) to be %v", rel, expected)
+		}
+	}
+
+	if !f.skip("drafts", true) || f.skip("images", true) {
+		t.Error("Expected only excluded folders to be skipped, regardless of includes")
+	}
+}
+
+func TestFileHashes(t *testing.T) {
+	filter, err := newFileFilter("test/output", nil, nil)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+
+	hashes, err := fileHashes("test/output", filter)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if expected := utils.FileHashesNew("test/output"); len(hashes) != len(expected) ||
+		hashes["foobar.html"] != expected["foobar.html"] || hashes["barbaz.txt"] != expected["barbaz.txt"] {
+		t.Errorf("Expected hashes to match utils.FileHashesNew %v, got %v", expected, hashes)
+	}
+}
+
+func TestFileHashesFiltered(t *testing.T) {
+	root, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the source folder:", err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		"index.html":         "index",
+		".DS_Store":          "junk",
+		"img/.DS_Store":      "junk",
+		".git/HEAD":          "ref",
+		"docs/a.html.swp":    "swap",
+		"docs/a.html":        "a",
+		"docs/notes.txt":     "notes",
+		ignoreFile:           "# junk\n.DS_Store\n\n.git/\n",
+		"docs/" + ignoreFile: "*.html\n",
+	}
+	for fname, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(fname))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter, err := newFileFilter(root, nil, []string{"*.swp"})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	hashes, err := fileHashes(root, filter)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+
+	fnames := []string{}
+	for fname := range hashes {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	// Only the root ignore file is honoured, the one in docs/ is uploaded as any other file.
+	if expected, actual := "docs/.go3upignore:docs/a.html:docs/notes.txt:index.html", strings.Join(fnames, ":"); expected != actual {
+		t.Errorf("Expected %s to be hashed, got %s", expected, actual)
+	}
+
+	if _, err = newFileFilter(root, []string{"[a"}, nil); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+}
@@ -1,8 +1,12 @@
 module github.com/alexaandru/go3up
 
-go 1.13
+go 1.21
 
 require (
 	github.com/alexaandru/utils v1.0.0
+	github.com/andybalholm/brotli v1.1.1
 	github.com/aws/aws-sdk-go v1.34.32
+	github.com/klauspost/compress v1.17.11
 )
+
+require github.com/jmespath/go-jmespath v0.4.0 // indirect
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// lockExt is the extension of the file holding the cache lock.
+const lockExt = ".lock"
+
+// errCacheLocked is returned by lockCache when another go3up run holds the lock.
+var errCacheLocked = errors.New("the cache file is in use by another go3up run")
+
+// lockCache takes an advisory lock on the cache file, to be held for the whole run, so that two
+// runs cannot both update it. The lock is taken on a separate fname+lockExt file, as the cache
+// itself is replaced on every write. The returned func releases it.
+func lockCache(fname string) (unlock func(), err error) {
+	f, err := os.OpenFile(fname+lockExt, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	if err = flock(f); err != nil {
+		_ = f.Close()
+		return
+	}
+
+	return func() {
+		_ = f.Close()
+	}, nil
+}
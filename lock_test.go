@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the temp folder:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "cache.txt")
+	unlock, err := lockCache(fname)
+	if err != nil {
+		t.Fatal("Expected the lock to be taken, got", err)
+	}
+
+	if _, err = lockCache(fname); err != errCacheLocked {
+		t.Error("Expected the lock to be held, got", err)
+	}
+
+	unlock()
+	if unlock, err = lockCache(fname); err != nil {
+		t.Fatal("Expected the lock to be released, got", err)
+	}
+	unlock()
+}
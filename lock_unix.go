@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive, non blocking, advisory lock on f, released once f is closed.
+func flock(f *os.File) (err error) {
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errCacheLocked
+	}
+
+	return
+}
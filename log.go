@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log formats
+const (
+	logHuman = "human"
+	logText  = "text"
+	logJSON  = "json"
+)
+
+// progressKey is the key of the attr holding the progress mark of an event (i.e. "." for an
+// uploaded file), which the human handler prints instead of the whole event, by default.
+const progressKey = "progress"
+
+// progress returns the attr holding the progress mark of an event.
+func progress(mark string) slog.Attr {
+	return slog.String(progressKey, mark)
+}
+
+// newLogger returns a logger writing to w (os.Stderr, for the structured formats and the plan
+// mode) in the given format, at the given level.
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	dropProgress := func(_ []string, a slog.Attr) slog.Attr {
+		if a.Key == progressKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+
+	switch format {
+	case logText:
+		return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: dropProgress}))
+	case logJSON:
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: dropProgress}))
+	}
+
+	return slog.New(newHumanHandler(w, level))
+}
+
+// initLogger sets up the logger as per the options.
+func initLogger(opts *options) {
+	level := slog.LevelInfo
+	if opts.verbose {
+		level = slog.LevelDebug
+	} else if opts.quiet {
+		level = slog.LevelWarn
+	}
+
+	// The plan goes to stdout, so it can be piped elsewhere: keep the logs out of it.
+	w := io.Writer(os.Stdout)
+	if opts.LogFormat == logText || opts.LogFormat == logJSON || opts.plan {
+		w = os.Stderr
+	}
+
+	logger = newLogger(w, opts.LogFormat, level)
+	if h, ok := logger.Handler().(*humanHandler); ok && progressBarEnabled(opts) {
+		h.hideMarks = true
+	}
+}
+
+// humanHandler is a slog.Handler printing the events in a compact, human friendly, form: one line
+// per event (message, followed by its fields) except, at the default (info) level, for the events
+// with a progress mark, which only get their mark printed (i.e. one dot per uploaded file).
+// When hideMarks is set (i.e. while the progress bar is shown), those events are not printed at all,
+// and the lines are printed over the progress bar, which gets redrawn afterwards.
+// Groups are not supported, their attrs are printed as if ungrouped.
+type humanHandler struct {
+	w         io.Writer
+	level     slog.Level
+	attrs     []slog.Attr
+	hideMarks bool
+	state     *humanState
+}
+
+// humanState is shared by a handler and the ones derived from it (via WithAttrs).
+type humanState struct {
+	marks bool // whether the last thing printed was a progress mark.
+	sync.Mutex
+}
+
+func newHumanHandler(w io.Writer, level slog.Level) *humanHandler {
+	return &humanHandler{w: w, level: level, state: &humanState{}}
+}
+
+func (h *humanHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *humanHandler) Handle(_ context.Context, r slog.Record) (err error) {
+	mark, line := "", &strings.Builder{}
+	line.WriteString(r.Message)
+	collect := func(a slog.Attr) bool {
+		if a.Key == progressKey {
+			mark = a.Value.String()
+		} else if !a.Equal(slog.Attr{}) {
+			fmt.Fprintf(line, " %s=%v", a.Key, a.Value)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		collect(a)
+	}
+	r.Attrs(collect)
+
+	h.state.Lock()
+	defer h.state.Unlock()
+
+	if mark != "" && h.level == slog.LevelInfo {
+		if !h.hideMarks {
+			h.state.marks = true
+			_, err = io.WriteString(h.w, mark)
+		}
+		return
+	}
+
+	out := line.String() + "\n"
+	if h.hideMarks {
+		out = "\r\033[K" + out
+	} else if h.state.marks {
+		h.state.marks, out = false, "\n"+out
+	}
+	_, err = io.WriteString(h.w, out)
+
+	return
+}
+
+func (h *humanHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+
+	return &h2
+}
+
+func (h *humanHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
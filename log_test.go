@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestHumanHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := newLogger(buf, logHuman, slog.LevelInfo)
+	log.Info("There are 2 files to be uploaded")
+	log.Info("Uploaded", "key", "foobar.html", progress("."))
+	log.Error("Failed to upload", "key", "barbaz.txt", "error", errors.New("access denied"), progress("F"))
+	log.Debug("Done uploading files.")
+	log.With("target", "example_bucket").Info("All done!")
+
+	if expected := "There are 2 files to be uploaded\n.F\nAll done! target=example_bucket\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	log = newLogger(buf, logHuman, slog.LevelDebug)
+	log.Info("Uploaded", "key", "foobar.html", "size", 123, progress("."))
+	log.Debug("Done uploading files.")
+	if expected := "Uploaded key=foobar.html size=123\nDone uploading files.\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	h := newHumanHandler(buf, slog.LevelInfo)
+	h.hideMarks = true
+	log = slog.New(h)
+	log.Info("Uploaded", "key", "foobar.html", progress("."))
+	log.Info("All done!")
+	if expected := "\r\033[KAll done!\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	log = newLogger(buf, logHuman, slog.LevelWarn)
+	log.Info("Uploaded", "key", "foobar.html", progress("."))
+	log.Error("Failed to upload", "key", "barbaz.txt", "error", errors.New("access denied"), progress("F"))
+	if expected := "Failed to upload key=barbaz.txt error=access denied\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+}
+
+func TestNewLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	newLogger(buf, logJSON, slog.LevelInfo).Info("Uploaded", "key", "foobar.html", "attempt", 1, progress("."))
+
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatal("Expected a JSON event, got", buf.String(), err)
+	}
+	if event["msg"] != "Uploaded" || event["key"] != "foobar.html" || event["attempt"] != 1.0 {
+		t.Error("Expected the event fields to be logged, got", event)
+	}
+	if _, ok := event[progressKey]; ok {
+		t.Error("Expected the progress mark to be left out, got", event)
+	}
+}
@@ -1,21 +1,18 @@
 package main
 
 import (
-	"compress/gzip"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"math"
-	"mime"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"sort"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alexaandru/utils"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // Exit codes
@@ -25,118 +22,313 @@ const (
 	S3AuthError
 	CmdLineOptionError
 	CachingFailure
+	ListingFailure
+	Interrupted
+	CacheLocked
+	DeployLocked
+	PartialFailure
 )
 
 // max number of attempts to retry a failed upload.
 const maxTries = 10
 
-// signature of an s3 uploader func
-type uploader func(*sourceFile) error
+// max number of keys that can be deleted with a single S3 DeleteObjects call.
+const maxDeleteBatch = 1000
 
-// filesLists returns both the current files list as well as the difference from the old (cached) files list.
-func filesLists() (current utils.FileHashes, diff []string) {
-	current = utils.FileHashesNew(opts.Source)
-	old := utils.FileHashes{}
-	old.Load(opts.CacheFile)
-	diff = current.Diff(old)
+// signature of an uploader func
+type uploader func(context.Context, *sourceFile) error
+
+// filesLists returns the current files list, the old files list as well as the difference between them:
+// the files to be uploaded and the ones that only need their headers updated. The old files list is either
+// the cached one or, in mirror mode, the one actually found in the bucket.
+func filesLists(ctx context.Context) (current, old utils.FileHashes, diff, updates []string, err error) {
+	if current, err = localFiles(); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("local files: %v", err)
+	}
+	if opts.Mirror {
+		if old, err = remoteFilesList(ctx, current); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("remote files: %v", err)
+		}
+	} else {
+		old = utils.FileHashes{}
+		old.Load(opts.CacheFile)
+	}
+	diff, updates = cacheDiff(current, old)
+
+	return
+}
+
+// remoteFilesList lists the storage (restricted to the mappings prefixes) and returns the remote files, with
+// hashes comparable to the current ones.
+func remoteFilesList(ctx context.Context, current utils.FileHashes) (remote utils.FileHashes, err error) {
+	objects := []remoteFile{}
+	for _, prefix := range listPrefixes() {
+		found, err := store.list(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range found {
+			if obj.key != deployLockKey {
+				objects = append(objects, obj)
+			}
+		}
+	}
+
+	return remoteHashes(ctx, current, objects, store.head)
+}
+
+// rebuildCache recreates the cache from the bucket contents, so that the next run only uploads the files
+// that differ from their remote copy. Remote files with an unknown hash are left out, and so are the ones
+// missing locally, which go3up cannot tell it uploaded (so that -delete never removes them). It returns
+// the rebuilt cache and the number of files in it that match their local copy.
+func rebuildCache(ctx context.Context) (cache utils.FileHashes, matching int, err error) {
+	current, err := localFiles()
+	if err != nil {
+		return nil, 0, fmt.Errorf("local files: %v", err)
+	}
+	remote, err := remoteFilesList(ctx, current)
+	if err != nil {
+		return nil, 0, fmt.Errorf("remote files: %v", err)
+	}
+
+	cache = utils.FileHashes{}
+	for fname, hash := range remote {
+		if _, ok := current[fname]; !ok || hash == "" {
+			continue
+		}
+		if hash == current[fname] {
+			matching++
+		}
+		cache[fname] = hash
+	}
+
+	return
+}
+
+// removedFiles returns the (sorted) list of files present in the old list but missing from the current one.
+func removedFiles(current, old utils.FileHashes) (removed []string) {
+	removed = []string{}
+	for fname := range old {
+		if _, ok := current[fname]; !ok {
+			removed = append(removed, fname)
+		}
+	}
+	sort.Strings(removed)
+
+	return
+}
+
+// deleteBatches splits the fnames list into batches of at most maxDeleteBatch files each.
+func deleteBatches(fnames []string) (batches [][]string) {
+	for len(fnames) > maxDeleteBatch {
+		batches = append(batches, fnames[:maxDeleteBatch])
+		fnames = fnames[maxDeleteBatch:]
+	}
+	if len(fnames) > 0 {
+		batches = append(batches, fnames)
+	}
+
+	return
+}
+
+// workList builds the list of sourceFiles to be processed: the uploads first, then the headers updates
+// and finally the deletions. Variants whose compression does not pay off are deleted instead of
+// uploaded (in case an older version of them is stored) and need no headers updates.
+func workList(current, old utils.FileHashes, diff, updates []string, batches [][]string) (work []*sourceFile) {
+	sort.Strings(diff)
+	for _, fname := range diff {
+		sf := storedSourceFile(fname, current[fname], old[fname])
+		sf.hash = current[fname]
+		if sf.uncompressed != "" && sf.isVariant() {
+			sf.action, sf.deletes = actionDelete, []string{fname}
+		}
+		work = append(work, sf)
+	}
+	sort.Strings(updates)
+	for _, fname := range updates {
+		sf := storedSourceFile(fname, current[fname], old[fname])
+		if sf.uncompressed != "" && sf.isVariant() {
+			continue
+		}
+		sf.action, sf.hash = actionUpdate, current[fname]
+		work = append(work, sf)
+	}
+	for _, batch := range batches {
+		work = append(work, newDeleteBatch(batch))
+	}
+
+	return
+}
+
+// uploadsSize returns the total size of the files to be uploaded.
+func uploadsSize(work []*sourceFile) (size int64) {
+	for _, src := range work {
+		if src.action != actionUpload {
+			continue
+		}
+		if fi, err := os.Stat(src.fpath); err == nil {
+			size += fi.Size()
+		}
+	}
 
 	return
 }
 
-// upload fetches sourceFiles from uploads chan, attempts to upload them and enqueue the results to
-// completed list. On failure it attempts to retry, up to maxTries per source file.
-func upload(id string, fn uploader, uploads chan *sourceFile, rejected *syncedlist, wgUploads, wgWorkers *sync.WaitGroup) {
+// dispatch sends the work to the uploads chan, until ctx is cancelled. Whatever did not get sent
+// is rejected, so that it is not cached as uploaded.
+func dispatch(ctx context.Context, work []*sourceFile, uploads chan *sourceFile, rejected *syncedlist, wgUploads *sync.WaitGroup) {
+	for i, src := range work {
+		if ctx.Err() == nil {
+			select {
+			case uploads <- src:
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		for _, src := range work[i:] {
+			rejected.add(src.keys()...)
+			report.rejected(src, ctx.Err())
+			wgUploads.Done()
+		}
+		return
+	}
+}
+
+// upload fetches sourceFiles from uploads chan, attempts to upload them and records the results,
+// either as completed or as rejected. On failure it attempts to retry, up to maxTries per source file. Once stop is
+// cancelled, the pending uploads (and retries) are rejected. Once abort (the parent of stop) is cancelled, the ones
+// in progress are aborted too.
+func upload(stop, abort context.Context, id string, fn uploader, uploads chan *sourceFile, rejected *syncedlist, completed *checkpoint, wgUploads, wgWorkers *sync.WaitGroup) {
 	defer wgWorkers.Done()
 
 	for src := range uploads {
 		src := src
 
+		if stop.Err() != nil {
+			rejected.add(src.keys()...)
+			report.rejected(src, stop.Err())
+			logger.Info("Cancelled", "key", src.label(), progress("c"))
+			wgUploads.Done()
+			continue
+		}
+
 		if opts.dryRun {
-			say("Pretending to upload "+src.fname, ".")
+			logger.Info("Pretending to "+src.action, "key", src.label(), progress("."))
 			wgUploads.Done()
 			continue
 		}
 
-		err := fn(src)
+		start := time.Now()
+		err := fn(abort, src)
 		if err == nil {
+			completed.done(src)
+			report.done(src)
 			wgUploads.Done()
-			say("Uploaded "+src.fname, ".")
+			logger.Info(actionsDone[src.action], "key", src.label(), "size", src.size, "attempt", src.attempts+1,
+				"duration", time.Since(start), progress("."))
 			continue
 		}
 
 		src.recordAttempt()
 		if !src.retriable() || !isRecoverable(err) {
-			rejected.add(src.fname)
-			say("Failed to upload "+src.fname+": "+err.Error(), "F")
+			rejected.add(src.keys()...)
+			report.rejected(src, err)
+			logger.Error("Failed to "+src.action, "key", src.label(), "size", src.size, "attempt", src.attempts,
+				"duration", time.Since(start), "error", err, progress("F"))
 			wgUploads.Done()
 			continue
 		}
 
 		go func() {
-			say("Retrying "+src.fname, "r")
+			report.retried(src)
+			logger.Warn("Retrying", "key", src.label(), "attempt", src.attempts, "error", err, progress("r"))
 			wait := time.Duration(100.0*math.Pow(2, float64(src.attempts))) * time.Millisecond
 			if appEnv == "test" {
 				wait = time.Nanosecond
 			}
-			<-time.After(wait)
-			uploads <- src
+			select {
+			case <-time.After(wait):
+				uploads <- src
+			case <-stop.Done():
+				rejected.add(src.keys()...)
+				report.rejected(src, stop.Err())
+				wgUploads.Done()
+			}
 		}()
 	}
 }
 
-// Generate an S3 upload func. It holds the bucket in a closure.
-func s3putGen() (up uploader, err error) {
-	if appEnv == "test" {
-		return func(src *sourceFile) error {
-			// TODO: capture the sourceFile for testing
-			return nil
-		}, nil
+// uploaderGen returns an uploader func, carrying out the sourceFile action on the given backend.
+func uploaderGen(b backend) uploader {
+	return func(ctx context.Context, src *sourceFile) error {
+		switch src.action {
+		case actionUpdate:
+			return b.update(ctx, src)
+		case actionDelete:
+			failed, err := b.delete(ctx, src.deletes)
+			// Only retry the files that failed to be deleted.
+			if len(failed) > 0 {
+				src.deletes = failed
+			}
+			return err
+		}
+
+		return b.put(ctx, src)
 	}
+}
 
-	return func(src *sourceFile) (err error) {
-		f, err := os.Open(filepath.Join(opts.Source, src.fname))
-		if err != nil {
-			return err
+// signalContexts returns two contexts: stop gets cancelled on the first SIGINT/SIGTERM, meaning no new
+// work should be started, abort (the parent of stop) on the second one, meaning the work in progress
+// should be aborted too. Further signals get the default treatment. The returned func releases them.
+func signalContexts() (stop, abort context.Context, release func()) {
+	abort, cancelAbort := context.WithCancel(context.Background())
+	stop, cancelStop := context.WithCancel(abort)
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case <-sigs:
+		case <-done:
+			return
 		}
+		logger.Warn("Interrupted, finishing the uploads in progress (interrupt again to abort them).")
+		cancelStop()
 
-		var r io.Reader = f
-		cacheControl, contentEnc, contentType, sse := src.getHeader(CacheControl), src.getHeader(ContentEncoding),
-			mime.TypeByExtension(strings.ToLower(filepath.Ext(src.fname))), src.getHeader(Encryption)
-		if src.gzip {
-			rr, w := io.Pipe()
-			wz := gzip.NewWriter(w)
-			go func() {
-				// FIXME: We need a better way to handle these.
-				if _, err2 := io.Copy(wz, f); err2 != nil {
-					panic(fmt.Errorf("decryption error: %v", err2))
-				}
-				if err2 := wz.Close(); err2 != nil {
-					panic(fmt.Errorf("decryption error: %v", err2))
-				}
-				if err2 := w.Close(); err2 != nil {
-					panic(fmt.Errorf("decryption error: %v", err2))
-				}
-			}()
-
-			r = rr
-		}
-
-		u := s3manager.NewUploader(sess, func(opts *s3manager.Uploader) {
-			opts.S3 = s3svc
-			opts.LeavePartsOnError = false
-		})
-		_, err = u.Upload(&s3manager.UploadInput{
-			Key:                  &src.fname,
-			Body:                 r,
-			Bucket:               &opts.BucketName,
-			ContentType:          &contentType,
-			ContentEncoding:      contentEnc,
-			CacheControl:         cacheControl,
-			ServerSideEncryption: sse,
-		})
+		select {
+		case <-sigs:
+		case <-done:
+			return
+		}
+		logger.Warn("Aborting the uploads in progress.")
+		cancelAbort()
+	}()
+
+	return stop, abort, func() {
+		close(done)
+		cancelAbort()
+	}
+}
 
-		return err
-	}, nil
+// atExit holds the funcs to be run on exit (latest first), as os.Exit skips the deferred ones.
+var atExit []func()
+
+// exit records the code in the run report, runs the atExit funcs, then exits with the given code.
+func exit(code int) {
+	report.ExitCode = code
+	runAtExit()
+	os.Exit(code)
+}
+
+// runAtExit runs (and clears) the atExit funcs.
+func runAtExit() {
+	for len(atExit) > 0 {
+		fn := atExit[len(atExit)-1]
+		atExit = atExit[:len(atExit)-1]
+		fn()
+	}
 }
 
 func main() {
@@ -146,61 +338,173 @@ func main() {
 		os.Exit(CmdLineOptionError)
 	}
 
-	s3put, err := s3putGen()
-	if err != nil {
-		fmt.Println("S3 Error:", err)
-		os.Exit(S3AuthError)
+	report = newRunReport()
+	if opts.reportFile != "" {
+		atExit = append(atExit, func() {
+			if err := report.dump(opts.reportFile); err != nil {
+				fmt.Println("Saving the report failed: ", err)
+			}
+		})
+	}
+	defer runAtExit()
+
+	var err error
+	if store, err = newBackend(opts.Target); err != nil {
+		fmt.Println("Storage error:", err)
+		exit(SetupFailed)
+	}
+
+	if opts.doCache && !opts.dryRun && !opts.plan {
+		unlock, err := lockCache(opts.CacheFile)
+		if err == errCacheLocked {
+			fmt.Println("Caching failed: ", err)
+			exit(CacheLocked)
+		} else if err != nil {
+			fmt.Println("Caching failed: ", err)
+			exit(CachingFailure)
+		}
+		atExit = append(atExit, unlock)
+	}
+
+	stop, abort, release := signalContexts()
+	atExit = append(atExit, release)
+
+	if opts.forceUnlock {
+		if _, err := store.delete(stop, []string{deployLockKey}); err != nil {
+			fmt.Println("Removing the deploy lock failed: ", err)
+			exit(SetupFailed)
+		}
+		logger.Info("Deploy lock removed.")
+		exit(Success)
+	}
+
+	if opts.rebuildCache {
+		cache, matching, err := rebuildCache(stop)
+		if err != nil {
+			fmt.Println("Listing files failed: ", err)
+			exit(ListingFailure)
+		}
+		logger.Info(fmt.Sprintf("Found %d files in '%s', %d of them matching the local ones.", len(cache), store, matching))
+		if opts.dryRun {
+			logger.Info("Pretending to rebuild cache.")
+			exit(Success)
+		}
+		if err := dumpCache(cache, opts.CacheFile); err != nil {
+			fmt.Println("Caching failed: ", err)
+			exit(CachingFailure)
+		}
+		logger.Info("Done rebuilding cache.")
+		exit(Success)
+	}
+
+	if opts.Lock && opts.doUpload && !opts.dryRun && !opts.plan {
+		release, err := acquireDeployLock(stop, store, newDeployLock(opts.LockHolder, opts.LockTTL), time.Duration(opts.LockWait)*time.Second)
+		if _, ok := err.(lockedError); ok {
+			fmt.Println("Deploy lock: ", err)
+			exit(DeployLocked)
+		} else if stop.Err() != nil {
+			exit(Interrupted)
+		} else if err != nil {
+			fmt.Println("Deploy lock failed: ", err)
+			exit(SetupFailed)
+		}
+		atExit = append(atExit, release)
 	}
 
 	uploads, rejected := make(chan *sourceFile), &syncedlist{}
+	var completed *checkpoint
+	var bar *progressBar
 	wgUploads, wgWorkers := new(sync.WaitGroup), new(sync.WaitGroup)
 
-	current, diff := filesLists()
-	if len(diff) == 0 {
-		say("Nothing to upload.", "Nothing to upload.\n")
-		os.Exit(Success)
+	current, old, diff, updates, err := filesLists(stop)
+	if err != nil {
+		fmt.Println("Listing files failed: ", err)
+		exit(ListingFailure)
+	}
+	removed := []string{}
+	if opts.Delete || opts.Mirror {
+		removed = removedFiles(current, old)
 	}
-	say(fmt.Sprintf("There are %d files to be uploaded to '%s'", len(diff), opts.BucketName), "Uploading ")
+	report.Scanned, report.Diffed = len(current), len(diff)+len(updates)+len(removed)
+	if opts.plan {
+		if err := printPlan(os.Stdout, plan(current, old, diff, updates, removed), opts.planFormat); err != nil {
+			fmt.Println("Printing the plan failed: ", err)
+			exit(SetupFailed)
+		}
+		exit(Success)
+	}
+	if len(diff) == 0 && len(updates) == 0 && len(removed) == 0 {
+		logger.Info("Nothing to upload.")
+		exit(Success)
+	}
+	logger.Info(fmt.Sprintf("There are %d files to be uploaded to '%s'", len(diff), store))
+	if len(updates) > 0 {
+		logger.Info(fmt.Sprintf("There are %d files to have their headers updated in '%s'", len(updates), store))
+	}
+	if len(removed) > 0 {
+		logger.Info(fmt.Sprintf("There are %d files to be deleted from '%s'", len(removed), store))
+	}
+	work := workList(current, old, diff, updates, deleteBatches(removed))
 
 	if !opts.doUpload {
-		say("Skipping upload")
+		logger.Info("Skipping upload.")
 		goto Cache
 	}
 
-	wgUploads.Add(len(diff))
+	if opts.doCache && !opts.dryRun {
+		interval := time.Duration(opts.CheckpointInterval) * time.Second
+		completed = newCheckpoint(opts.CacheFile, current, old, work, opts.CheckpointEvery, interval)
+	}
+
+	if progressBarEnabled(opts) {
+		bar = startProgressBar(os.Stdout, report, report.Diffed, uploadsSize(work))
+	}
+
+	wgUploads.Add(len(work))
 	wgWorkers.Add(opts.WorkersCount)
 	for i := 0; i < opts.WorkersCount; i++ {
-		go upload(fmt.Sprintf("%d", i), s3put, uploads, rejected, wgUploads, wgWorkers)
+		go upload(stop, abort, fmt.Sprintf("%d", i), uploaderGen(store), uploads, rejected, completed, wgUploads, wgWorkers)
 	}
 
-	sort.Strings(diff)
-	for _, fname := range diff {
-		uploads <- newSourceFile(fname)
-	}
+	dispatch(stop, work, uploads, rejected, wgUploads)
 
 	wgUploads.Wait()
 	close(uploads)
 	wgWorkers.Wait()
-	say("Done uploading files.")
+	bar.stop()
+	logger.Debug("Done uploading files.")
 
 Cache:
 	if !opts.doCache {
-		say("Skipping cache.")
+		logger.Info("Skipping cache.")
 		goto Done
 	}
 
 	if opts.dryRun {
-		say("Pretending to update cache.")
+		logger.Info("Pretending to update cache.")
 		goto Done
 	}
 
-	current = current.Reject(rejected.list)
-	if err := current.Dump(opts.CacheFile); err != nil {
+	current = fingerprinted(current, old).Reject(rejected.list)
+	// Files that failed to be deleted or updated keep their old cache entry, so that they are retried on the next run.
+	for fname, hash := range old.Filter(rejected.list).Filter(append(updates, removed...)) {
+		current[fname] = hash
+	}
+	if err := dumpCache(current, opts.CacheFile); err != nil {
 		fmt.Println("Caching failed: ", err)
-		os.Exit(CachingFailure)
+		exit(CachingFailure)
 	}
-	say("Done updating cache.")
+	logger.Debug("Done updating cache.")
 
 Done:
-	say("All done!", " done!\n")
+	if stop.Err() != nil {
+		logger.Warn("Interrupted, the remaining files will be uploaded on the next run.")
+		exit(Interrupted)
+	}
+	if len(report.Rejected) > 0 {
+		fmt.Println()
+		printRejected(os.Stdout, report.Rejected)
+		exit(PartialFailure)
+	}
+	logger.Info("All done!")
 }
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/alexaandru/utils"
 )
 
 func TestFilesList(t *testing.T) {
 	cacheFile := opts.CacheFile
 	opts.CacheFile = "test/.cacheEmpty.txt"
-	current, diff := filesLists()
+	current, _, diff, _, err := filesLists(context.Background())
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
 
 	if current["barbaz.txt"] != "dac2e8bd758efb58a30f9fcd7ac28b1b" ||
 		current["foobar.html"] != "01677e4c0ae5468b9b8b823487f14524" {
@@ -26,6 +37,106 @@ func TestFilesList(t *testing.T) {
 	opts.CacheFile = cacheFile
 }
 
+func TestRemoteFilesList(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := b.create(ctx, "foobar.html", []byte("foobar"), ""); err != nil {
+		t.Fatal("Failed to store foobar.html:", err)
+	}
+	if err := b.create(ctx, deployLockKey, []byte("{}"), ""); err != nil {
+		t.Fatal("Failed to store the deploy lock:", err)
+	}
+
+	oldStore := store
+	store = b
+	remote, err := remoteFilesList(ctx, utils.FileHashes{})
+	store = oldStore
+	if err != nil || len(remote) != 1 || remote["foobar.html"] == "" {
+		t.Error("Expected the deploy lock to be left out of the listing, got", remote, err)
+	}
+}
+
+func TestRebuildCache(t *testing.T) {
+	b, cleanup := newTestFileBackend(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	sf := newSourceFile("foobar.html")
+	sf.hash = "01677e4c0ae5468b9b8b823487f14524"
+	if err := b.put(ctx, sf); err != nil {
+		t.Fatal("Failed to store foobar.html:", err)
+	}
+	for _, fname := range []string{"barbaz.txt", "other-team.txt"} {
+		if err := b.create(ctx, fname, []byte("changed"), ""); err != nil {
+			t.Fatal("Failed to store", fname, err)
+		}
+	}
+
+	oldStore := store
+	store = b
+	cache, matching, err := rebuildCache(ctx)
+	store = oldStore
+	if err != nil {
+		t.Fatal("Expected the cache to be rebuilt, got", err)
+	}
+	if len(cache) != 2 || cache["foobar.html"] != sf.hash || cache["barbaz.txt"] == "" {
+		t.Error("Expected the local files found remotely to be cached, got", cache)
+	}
+	if _, ok := cache["other-team.txt"]; ok {
+		t.Error("Expected the remote only files to be left out, got", cache)
+	}
+	if matching != 1 {
+		t.Error("Expected only foobar.html to match its local copy, got", matching)
+	}
+
+	// The rebuilt entries have no fingerprint: foobar.html is known to be stored gzipped, as per its
+	// rule, and is left alone, even though it is under the compression thresholds.
+	minSize := opts.CompressMinSize
+	defer func() { opts.CompressMinSize = minSize }()
+	opts.CompressMinSize = 1 << 20
+	current := utils.FileHashes{"foobar.html": sf.hash}
+	if diff, updates := cacheDiff(current, cache); len(diff)+len(updates) != 0 {
+		t.Error("Expected the unchanged file to be left alone, got", diff, updates)
+	}
+	if _, _, enc := splitCacheEntry(fingerprinted(current, cache)["foobar.html"]); enc != "gzip" {
+		t.Error("Expected the unchanged file to be cached as gzipped, got", enc)
+	}
+}
+
+func TestRemovedFiles(t *testing.T) {
+	current := utils.FileHashes{"a.html": "1", "b.html": "2"}
+	old := utils.FileHashes{"c.html": "3", "a.html": "0", "0.txt": "4"}
+
+	if actual := strings.Join(removedFiles(current, old), ":"); actual != "0.txt:c.html" {
+		t.Error("Expected 0.txt and c.html to be removed, got", actual)
+	}
+
+	if actual := removedFiles(current, utils.FileHashes{}); len(actual) != 0 {
+		t.Error("Expected nothing to be removed, got", actual)
+	}
+}
+
+func TestDeleteBatches(t *testing.T) {
+	fnames := make([]string, 2*maxDeleteBatch+1)
+	for i := range fnames {
+		fnames[i] = fmt.Sprintf("%d.html", i)
+	}
+
+	batches := deleteBatches(fnames)
+	if len(batches) != 3 {
+		t.Fatal("Expected 3 batches, got", len(batches))
+	}
+	if len(batches[0]) != maxDeleteBatch || len(batches[2]) != 1 || batches[2][0] != fnames[2*maxDeleteBatch] {
+		t.Error("Expected batches to be split at maxDeleteBatch, got", len(batches[0]), len(batches[1]), len(batches[2]))
+	}
+
+	if batches = deleteBatches(nil); len(batches) != 0 {
+		t.Error("Expected no batches for an empty list, got", batches)
+	}
+}
+
 func TestUpload(t *testing.T) {
 	upFn, uploads := fakeUploaderGen()
 	up := make(chan *sourceFile)
@@ -37,7 +148,7 @@ func TestUpload(t *testing.T) {
 
 	opts.verbose = false
 	opts.quiet = true
-	go upload("a", upFn, up, rejected, wgUploads, wgWorkers)
+	go upload(context.Background(), context.Background(), "a", upFn, up, rejected, nil, wgUploads, wgWorkers)
 
 	up <- newSourceFile("foobar.html")
 	up <- newSourceFile("barbaz.txt")
@@ -65,7 +176,7 @@ func TestUploadDryRun(t *testing.T) {
 	opts.dryRun = true
 	opts.verbose = false
 	opts.quiet = true
-	go upload("b", upFn, up, rejected, wgUploads, wgWorkers)
+	go upload(context.Background(), context.Background(), "b", upFn, up, rejected, nil, wgUploads, wgWorkers)
 
 	up <- newSourceFile("foobar.html")
 	up <- newSourceFile("barbaz.txt")
@@ -92,7 +203,7 @@ func TestUploadUnrecoverable(t *testing.T) {
 
 	opts.verbose = false
 	opts.quiet = true
-	go upload("c", upFn, up, rejected, wgUploads, wgWorkers)
+	go upload(context.Background(), context.Background(), "c", upFn, up, rejected, nil, wgUploads, wgWorkers)
 
 	up <- newSourceFile("foobar.html")
 	up <- newSourceFile("barbaz.txt")
@@ -110,6 +221,125 @@ func TestUploadUnrecoverable(t *testing.T) {
 	}
 }
 
+func TestUploadDeleteUnrecoverable(t *testing.T) {
+	upFn, uploads := fakeUploaderGen(fatalError)
+	up := make(chan *sourceFile)
+	rejected := &syncedlist{}
+	wgUploads, wgWorkers := new(sync.WaitGroup), new(sync.WaitGroup)
+
+	wgUploads.Add(1)
+	wgWorkers.Add(1)
+
+	opts.verbose = false
+	opts.quiet = true
+	go upload(context.Background(), context.Background(), "f", upFn, up, rejected, nil, wgUploads, wgWorkers)
+
+	up <- newDeleteBatch([]string{"gone.html", "gone.txt"})
+
+	wgUploads.Wait()
+	close(up)
+	wgWorkers.Wait()
+	opts.quiet = false
+
+	if len(*uploads) != 1 || (*uploads)[0].action != actionDelete {
+		t.Fatal("Expected the delete batch to be processed, got", *uploads)
+	}
+	if strings.Join(rejected.list, ":") != "gone.html:gone.txt" {
+		t.Fatal("Expected all the files in the batch to be rejected, got", rejected.list)
+	}
+}
+
+func TestUploadCancelled(t *testing.T) {
+	upFn, uploads := fakeUploaderGen()
+	up := make(chan *sourceFile)
+	rejected := &syncedlist{}
+	wgUploads, wgWorkers := new(sync.WaitGroup), new(sync.WaitGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	wgUploads.Add(2)
+	wgWorkers.Add(1)
+
+	opts.verbose = false
+	opts.quiet = true
+	go upload(ctx, ctx, "g", upFn, up, rejected, nil, wgUploads, wgWorkers)
+
+	up <- newSourceFile("foobar.html")
+	up <- newSourceFile("barbaz.txt")
+
+	wgUploads.Wait()
+	close(up)
+	wgWorkers.Wait()
+	opts.quiet = false
+
+	if len(*uploads) != 0 {
+		t.Fatal("Expected nothing to be uploaded once cancelled, got", *uploads)
+	}
+	if len(rejected.list) != 2 {
+		t.Fatal("Expected all of the uploads to be rejected, got", rejected.list)
+	}
+}
+
+func TestUploadStopped(t *testing.T) {
+	upFn, uploads := fakeUploaderGen(recoverableError)
+	up := make(chan *sourceFile)
+	rejected := &syncedlist{}
+	wgUploads, wgWorkers := new(sync.WaitGroup), new(sync.WaitGroup)
+	stop, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first (failing) attempt stops the run, so it is not retried.
+	stopping := func(ctx context.Context, src *sourceFile) error {
+		cancel()
+		return upFn(ctx, src)
+	}
+
+	wgUploads.Add(1)
+	wgWorkers.Add(1)
+
+	opts.verbose = false
+	opts.quiet = true
+	go upload(stop, context.Background(), "h", stopping, up, rejected, nil, wgUploads, wgWorkers)
+
+	up <- newSourceFile("foobar.html")
+
+	wgUploads.Wait()
+	close(up)
+	wgWorkers.Wait()
+	opts.quiet = false
+
+	if len(*uploads) != 1 {
+		t.Fatal("Expected no retries once stopped, got", len(*uploads), "attempts")
+	}
+	if len(rejected.list) != 1 {
+		t.Fatal("Expected the upload to be rejected, got", rejected.list)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	work := workList(utils.FileHashes{"a.html": "1", "b.html": "2"}, utils.FileHashes{}, []string{"b.html"}, []string{"a.html"}, [][]string{{"c.html", "d.html"}})
+	if len(work) != 3 || work[0].fname != "b.html" || work[0].hash != "2" || work[1].action != actionUpdate || work[2].action != actionDelete {
+		t.Fatal("Expected uploads, then updates, then deletes, got", work)
+	}
+
+	up, rejected, wgUploads := make(chan *sourceFile, len(work)), &syncedlist{}, new(sync.WaitGroup)
+	wgUploads.Add(len(work))
+	dispatch(context.Background(), work, up, rejected, wgUploads)
+	if len(up) != len(work) || len(rejected.list) != 0 {
+		t.Error("Expected all the work to be dispatched, got", len(up), rejected.list)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	up, rejected, wgUploads = make(chan *sourceFile), &syncedlist{}, new(sync.WaitGroup)
+	wgUploads.Add(len(work))
+	dispatch(ctx, work, up, rejected, wgUploads)
+	wgUploads.Wait()
+	if strings.Join(rejected.list, ":") != "b.html:a.html:c.html:d.html" {
+		t.Error("Expected all the work to be rejected once cancelled, got", rejected.list)
+	}
+}
+
 func TestUploadRecoverable(t *testing.T) {
 	upFn, uploads := fakeUploaderGen(recoverableError)
 	_ = uploads
@@ -122,8 +352,8 @@ func TestUploadRecoverable(t *testing.T) {
 
 	opts.quiet = true
 	opts.verbose = false
-	go upload("d", upFn, up, rejected, wgUploads, wgWorkers)
-	go upload("e", upFn, up, rejected, wgUploads, wgWorkers)
+	go upload(context.Background(), context.Background(), "d", upFn, up, rejected, nil, wgUploads, wgWorkers)
+	go upload(context.Background(), context.Background(), "e", upFn, up, rejected, nil, wgUploads, wgWorkers)
 
 	sf1, sf2 := newSourceFile("barbaz.txt"), newSourceFile("foobar.html")
 	up <- sf1
@@ -145,29 +375,153 @@ func TestUploadRecoverable(t *testing.T) {
 	}
 }
 
+// withTempCache points the cache file to a fresh (empty) temporary one, for the duration of the test,
+// so that the test/.go3up.txt fixture is left untouched.
+func withTempCache(t *testing.T) {
+	cacheFile := opts.CacheFile
+	t.Cleanup(func() { opts.CacheFile = cacheFile })
+
+	opts.CacheFile = filepath.Join(t.TempDir(), ".go3up.txt")
+	if err := ioutil.WriteFile(opts.CacheFile, nil, 0644); err != nil {
+		t.Fatal("Failed to create the cache file:", err)
+	}
+}
+
 func TestIntegrationMain(t *testing.T) {
-	if _, err := os.Create(opts.CacheFile); err != nil {
-		t.Fatal("Failed to truncate the cache file")
+	withTempCache(t)
+
+	target, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the target folder:", err)
 	}
+	defer os.RemoveAll(target)
 
-	upFn, uploads := fakeUploaderGen()
-	_ = upFn
-	opts.Region = "us-west-1"
+	opts.Target, opts.reportFile = fileScheme+target, filepath.Join(target, "report.json")
 	opts.quiet = true
 	main()
 	opts.quiet = false
+	opts.Target, opts.reportFile = "", ""
 
-	fnames := make([]string, len(*uploads))
-	for k, v := range *uploads {
-		fnames[k] = v.fname
+	data, err := ioutil.ReadFile(filepath.Join(target, "report.json"))
+	if err != nil {
+		t.Fatal("Failed to read the report:", err)
+	}
+	if err = os.Remove(filepath.Join(target, "report.json")); err != nil {
+		t.Fatal("Failed to remove the report:", err)
+	}
+	saved := runReport{}
+	if err = json.Unmarshal(data, &saved); err != nil || saved.Scanned != 2 || saved.Uploaded != 2 || saved.ExitCode != Success {
+		t.Error("Expected the report to be saved, got", string(data), err)
+	}
+
+	objects, err := (&fileBackend{root: target}).list(context.Background(), "")
+	if err != nil {
+		t.Fatal("Failed to list the target folder:", err)
+	}
+	fnames := make([]string, len(objects))
+	for k, v := range objects {
+		fnames[k] = v.key
 	}
 	sort.Strings(fnames)
-	t.Skip("Not really tested for now, other than seeing that it does not break. Will need some assertions.")
-	// if expected, actual := "barbaz.txt:foobar.html", strings.Join(fnames, ":"); expected != actual {
-	// 	t.Fatalf("Expected %s to be uploaded got %s", expected, actual)
-	// }
+	if expected, actual := "barbaz.txt:foobar.html", strings.Join(fnames, ":"); expected != actual {
+		t.Fatalf("Expected %s to be uploaded got %s", expected, actual)
+	}
+
+	r, err := (&fileBackend{root: target}).head(context.Background(), "foobar.html")
+	if err != nil {
+		t.Fatal("Failed to read foobar.html details:", err)
+	}
+	if r.hash != "01677e4c0ae5468b9b8b823487f14524" || r.hdrs[ContentEncoding] != "gzip" {
+		t.Error("Expected foobar.html to be stored gzipped along with its hash, got", r)
+	}
+
+	cache := utils.FileHashes{}
+	cache.Load(opts.CacheFile)
+	if len(cache) != 2 {
+		t.Error("Expected the cache to be updated, got", cache)
+	}
+}
+
+func TestIntegrationMainS3(t *testing.T) {
+	withTempCache(t)
+
+	b, cleanup := newTestS3Backend(t)
+	defer cleanup()
+
+	// Everything goes under a dedicated prefix, so that a real bucket is left as it was.
+	uploaded := []string{"go3up-test-main/barbaz.txt", "go3up-test-main/foobar.html"}
+	defer func() {
+		if failed, err := b.delete(context.Background(), uploaded); err != nil || len(failed) != 0 {
+			t.Error("Failed to clean up the bucket:", failed, err)
+		}
+	}()
+
+	svc, bucket, prefix := s3svc, opts.BucketName, opts.Prefix
+	s3svc, opts.BucketName, opts.Prefix = b.svc, b.bucket, "go3up-test-main"
+	opts.quiet = true
+	main()
+	opts.quiet = false
+	s3svc, opts.BucketName, opts.Prefix = svc, bucket, prefix
+
+	objects, err := b.list(context.Background(), "go3up-test-main/")
+	if err != nil {
+		t.Fatal("Failed to list the bucket:", err)
+	}
+	fnames := make([]string, len(objects))
+	for k, v := range objects {
+		fnames[k] = v.key
+	}
+	if expected, actual := strings.Join(uploaded, ":"), strings.Join(fnames, ":"); expected != actual {
+		t.Fatalf("Expected %s to be uploaded got %s", expected, actual)
+	}
 }
 
 func TestIntegrationPartialUpload(t *testing.T) {
 	t.Skip()
 }
+
+func TestIntegrationPlanJSON(t *testing.T) {
+	withTempCache(t)
+	withVariants(t, map[string]time.Time{"app.js": time.Now(), "app.js.gz": time.Now().Add(-time.Hour)})
+
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal("Failed to create the stdout file:", err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal("Failed to create the stderr file:", err)
+	}
+	defer stderr.Close()
+
+	oldStdout, oldStderr, oldLogger := os.Stdout, os.Stderr, logger
+	os.Stdout, os.Stderr = stdout, stderr
+	opts.Target, opts.plan, opts.planFormat = fileScheme+dir, true, planJSON
+	initLogger(opts)
+	func() {
+		// main ends with os.Exit(0), which panics while testing.
+		defer func() { _ = recover() }()
+		main()
+	}()
+	os.Stdout, os.Stderr, logger = oldStdout, oldStderr, oldLogger
+	opts.Target, opts.plan, opts.planFormat = "", false, planTable
+
+	out, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal("Failed to read stdout:", err)
+	}
+	actions := []planAction{}
+	if err = json.Unmarshal(out, &actions); err != nil || len(actions) != 1 || actions[0].Key != "app.js" {
+		t.Error("Expected stdout to only hold the JSON plan, got", string(out), err)
+	}
+
+	logs, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal("Failed to read stderr:", err)
+	}
+	if !strings.Contains(string(logs), "Ignoring stale precompressed file") {
+		t.Error("Expected the logs to go to stderr, got", string(logs))
+	}
+}
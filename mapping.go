@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alexaandru/utils"
+)
+
+// mapping maps a local source folder to a destination prefix in the bucket.
+type mapping struct {
+	Source string
+	Prefix string `json:",omitempty"`
+}
+
+// key returns the (remote) key of a file, given its path relative to the mapping source.
+func (m mapping) key(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if prefix := strings.Trim(m.Prefix, "/"); prefix != "" {
+		return prefix + "/" + rel
+	}
+
+	return rel
+}
+
+// rel returns the path relative to the mapping source of a key, if the key falls under the mapping prefix.
+func (m mapping) rel(key string) (rel string, ok bool) {
+	prefix := strings.Trim(m.Prefix, "/")
+	if prefix == "" {
+		return key, true
+	}
+	if !strings.HasPrefix(key, prefix+"/") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(key, prefix+"/"), true
+}
+
+// mappings returns the mappings in use: the ones explicitly given or else the one
+// implied by the Source and Prefix options.
+func (o *options) mappings() []mapping {
+	if len(o.Mappings) > 0 {
+		return o.Mappings
+	}
+
+	return []mapping{{Source: o.Source, Prefix: o.Prefix}}
+}
+
+// localFiles returns the hashes of all the local files, from all the mappings, keyed by their remote key,
+// along with their precompressed variants, if any (see addVariants).
+func localFiles() (current utils.FileHashes, err error) {
+	current = utils.FileHashes{}
+	for _, m := range opts.mappings() {
+		filter, err := newFileFilter(m.Source, opts.Include, opts.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		hashes, err := fileHashes(m.Source, filter)
+		if err != nil {
+			return nil, err
+		}
+		for rel, hash := range hashes {
+			key := m.key(rel)
+			if _, ok := current[key]; ok {
+				return nil, fmt.Errorf("%s is mapped more than once (last from %s)", key, m.Source)
+			}
+			current[key] = hash
+		}
+	}
+
+	addVariants(current)
+
+	return
+}
+
+// fileHashes walks the root folder and returns the hashes of the files not skipped by the filter,
+// keyed by their path relative to root. Skipped files are not even read. The hashes are computed
+// the same way utils.FileHashesNew does (md5 of the content, with leading and trailing new lines
+// trimmed), so that existing caches remain valid.
+func fileHashes(root string, filter *fileFilter) (hashes utils.FileHashes, err error) {
+	hashes = utils.FileHashes{}
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if filter.skip(rel, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if fi.IsDir() {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hashes[filepath.ToSlash(rel)] = fmt.Sprintf("%x", md5.Sum(bytes.Trim(data, "\n")))
+
+		return nil
+	})
+
+	return
+}
+
+// localPath returns the path of the local file corresponding to a key.
+func localPath(key string) string {
+	candidates := []string{}
+	for _, m := range opts.mappings() {
+		if rel, ok := m.rel(key); ok {
+			candidates = append(candidates, filepath.Join(m.Source, filepath.FromSlash(rel)))
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return filepath.Join(opts.Source, filepath.FromSlash(key))
+	case 1:
+		return candidates[0]
+	}
+
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return candidates[0]
+}
+
+// listPrefixes returns the prefixes the remote files listing must be restricted to,
+// so that files outside of the mappings are never considered. A blank prefix means
+// the whole bucket.
+func listPrefixes() (prefixes []string) {
+	all := []string{}
+	for _, m := range opts.mappings() {
+		prefix := strings.Trim(m.Prefix, "/")
+		if prefix == "" {
+			return []string{""}
+		}
+		all = append(all, prefix+"/")
+	}
+	sort.Strings(all)
+
+	// Prefixes nested into others are already covered by those.
+	for _, prefix := range all {
+		if n := len(prefixes); n == 0 || !strings.HasPrefix(prefix, prefixes[n-1]) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return
+}
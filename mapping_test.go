@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMappingKey(t *testing.T) {
+	tests := map[mapping]string{
+		{Source: "out"}:                    "a/b.html",
+		{Source: "out", Prefix: "docs/v2"}: "docs/v2/a/b.html",
+		{Source: "out", Prefix: "/docs/"}:  "docs/a/b.html",
+	}
+
+	for m, expected := range tests {
+		if actual := m.key("a/b.html"); actual != expected {
+			t.Errorf("Expected key of %v to be %s got %s", m, expected, actual)
+		}
+		if rel, ok := m.rel(expected); !ok || rel != "a/b.html" {
+			t.Errorf("Expected %s to map back to a/b.html for %v, got %s", expected, m, rel)
+		}
+	}
+
+	if _, ok := (mapping{Source: "out", Prefix: "docs"}).rel("docsy/a.html"); ok {
+		t.Error("Expected docsy/a.html NOT to fall under the docs prefix")
+	}
+}
+
+func TestLocalFiles(t *testing.T) {
+	mappings := opts.Mappings
+	defer func() { opts.Mappings = mappings }()
+
+	opts.Mappings = []mapping{{Source: "test/output", Prefix: "a"}, {Source: "test/output", Prefix: "b/c"}}
+	current, err := localFiles()
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if len(current) != 4 || current["a/foobar.html"] != "01677e4c0ae5468b9b8b823487f14524" || current["b/c/barbaz.txt"] == "" {
+		t.Error("Expected files to be keyed by prefix, got", current)
+	}
+	if path := localPath("b/c/barbaz.txt"); path != "test/output/barbaz.txt" {
+		t.Error("Expected b/c/barbaz.txt to map to test/output/barbaz.txt, got", path)
+	}
+
+	opts.Mappings = []mapping{{Source: "test/output"}, {Source: "test/output"}}
+	if _, err = localFiles(); err == nil {
+		t.Error("Expected files mapped twice to fail")
+	}
+}
+
+func TestListPrefixes(t *testing.T) {
+	mappings := opts.Mappings
+	defer func() { opts.Mappings = mappings }()
+
+	opts.Mappings = []mapping{{Source: "a", Prefix: "docs/v2"}, {Source: "b", Prefix: "blog"}, {Source: "c", Prefix: "docs/"}}
+	if actual := strings.Join(listPrefixes(), ":"); actual != "blog/:docs/" {
+		t.Error("Expected blog/ and docs/ prefixes, got", actual)
+	}
+
+	opts.Mappings = append(opts.Mappings, mapping{Source: "d"})
+	if actual := listPrefixes(); len(actual) != 1 || actual[0] != "" {
+		t.Error("Expected the whole bucket to be listed, got", actual)
+	}
+}
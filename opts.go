@@ -4,20 +4,63 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type options struct {
-	WorkersCount int    `json:",omitempty"`
-	BucketName   string `json:",omitempty"`
-	Source       string `json:",omitempty"`
-	CacheFile    string `json:",omitempty"`
-	Region       string `json:",omitempty"`
-	Profile      string `json:",omitempty"`
-	Encrypt      bool   `json:",omitempty"`
+	WorkersCount       int          `json:",omitempty"`
+	BucketName         string       `json:",omitempty"`
+	Target             string       `json:",omitempty"`
+	Source             string       `json:",omitempty"`
+	Prefix             string       `json:",omitempty"`
+	Mappings           []mapping    `json:",omitempty"`
+	Include            []string     `json:",omitempty"`
+	Exclude            []string     `json:",omitempty"`
+	CacheFile          string       `json:",omitempty"`
+	Region             string       `json:",omitempty"`
+	Profile            string       `json:",omitempty"`
+	Endpoint           string       `json:",omitempty"`
+	ForcePathStyle     bool         `json:",omitempty"`
+	DisableSSL         bool         `json:",omitempty"`
+	Encrypt            bool         `json:",omitempty"`
+	Delete             bool         `json:",omitempty"`
+	Mirror             bool         `json:",omitempty"`
+	RulesFile          string       `json:",omitempty"`
+	CheckpointEvery    int          `json:",omitempty"`
+	CheckpointInterval int          `json:",omitempty"`
+	Lock               bool         `json:",omitempty"`
+	LockHolder         string       `json:",omitempty"`
+	LockTTL            int          `json:",omitempty"`
+	LockWait           int          `json:",omitempty"`
+	LogFormat          string       `json:",omitempty"`
+	CompressMinSize    int64        `json:",omitempty"`
+	CompressMinSavings int          `json:",omitempty"`
+	Rules              []headerRule `json:",omitempty"`
 
 	dryRun, verbose, quiet,
-	doCache, doUpload, saveCfg bool
-	cfgFile string
+	doCache, doUpload, saveCfg,
+	rebuildCache, forceUnlock, plan,
+	progress bool
+	cfgFile, planFormat, reportFile string
+}
+
+// stringsFlag is a command line flag that can be given multiple times, collecting its values into a list.
+type stringsFlag struct {
+	list *[]string
+}
+
+func (s stringsFlag) String() string {
+	if s.list == nil {
+		return ""
+	}
+
+	return strings.Join(*s.list, ", ")
+}
+
+func (s stringsFlag) Set(val string) error {
+	*s.list = append(*s.list, val)
+
+	return nil
 }
 
 func (o *options) dump(fname string) (err error) {
@@ -77,9 +120,24 @@ func (o *options) merge(other options) {
 	if x := other.BucketName; x != "" {
 		o.BucketName = x
 	}
+	if x := other.Target; x != "" {
+		o.Target = x
+	}
 	if x := other.Source; x != "" {
 		o.Source = x
 	}
+	if x := other.Prefix; x != "" {
+		o.Prefix = x
+	}
+	if x := other.Mappings; len(x) > 0 {
+		o.Mappings = x
+	}
+	if x := other.Include; len(x) > 0 {
+		o.Include = x
+	}
+	if x := other.Exclude; len(x) > 0 {
+		o.Exclude = x
+	}
 	if x := other.CacheFile; x != "" {
 		o.CacheFile = x
 	}
@@ -89,9 +147,57 @@ func (o *options) merge(other options) {
 	if x := other.Profile; x != "" {
 		o.Profile = x
 	}
+	if x := other.Endpoint; x != "" {
+		o.Endpoint = x
+	}
+	if x := other.ForcePathStyle; x {
+		o.ForcePathStyle = x
+	}
+	if x := other.DisableSSL; x {
+		o.DisableSSL = x
+	}
 	if x := other.Encrypt; x {
 		o.Encrypt = x
 	}
+	if x := other.Delete; x {
+		o.Delete = x
+	}
+	if x := other.Mirror; x {
+		o.Mirror = x
+	}
+	if x := other.RulesFile; x != "" {
+		o.RulesFile = x
+	}
+	if x := other.LogFormat; x != "" {
+		o.LogFormat = x
+	}
+	if x := other.Rules; len(x) > 0 {
+		o.Rules = x
+	}
+	if x := other.CheckpointEvery; x != 0 {
+		o.CheckpointEvery = x
+	}
+	if x := other.CheckpointInterval; x != 0 {
+		o.CheckpointInterval = x
+	}
+	if x := other.Lock; x {
+		o.Lock = x
+	}
+	if x := other.LockHolder; x != "" {
+		o.LockHolder = x
+	}
+	if x := other.LockTTL; x != 0 {
+		o.LockTTL = x
+	}
+	if x := other.LockWait; x != 0 {
+		o.LockWait = x
+	}
+	if x := other.CompressMinSize; x != 0 {
+		o.CompressMinSize = x
+	}
+	if x := other.CompressMinSavings; x != 0 {
+		o.CompressMinSavings = x
+	}
 
 	// skipping the rest of the fields, they can never come from an unmarshalled file anyway.
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/alexaandru/utils"
+)
+
+// Plan actions
+const (
+	planUpload = "upload"
+	planUpdate = "update-headers"
+	planDelete = "delete"
+	planSkip   = "skip"
+)
+
+// Plan formats
+const (
+	planTable = "table"
+	planJSON  = "json"
+)
+
+// planAction describes what a run would do with a file, and why.
+type planAction struct {
+	Key         string
+	Action      string
+	Reason      string
+	Size        int64   `json:",omitempty"`
+	Headers     headers `json:",omitempty"`
+	Compression string  `json:",omitempty"`
+}
+
+// plan resolves the files lists into the (sorted by key) list of actions a run would carry out.
+// Unchanged files are included too, as skipped.
+func plan(current, old utils.FileHashes, diff, updates, removed []string) (actions []planAction) {
+	reasons := map[string]string{}
+	for _, fname := range diff {
+		oldHash, _, _ := splitCacheEntry(old[fname])
+		switch {
+		case old[fname] == "":
+			reasons[fname] = "new file"
+		case oldHash != current[fname]:
+			reasons[fname] = "content changed"
+		default:
+			reasons[fname] = "content encoding changed"
+		}
+	}
+	for _, fname := range updates {
+		reasons[fname] = "headers changed"
+	}
+
+	for fname := range current {
+		sf, action, reason := storedSourceFile(fname, current[fname], old[fname]), planSkip, "unchanged"
+		if r, ok := reasons[fname]; ok {
+			action, reason = planUpload, r
+			if r == "headers changed" {
+				action = planUpdate
+			}
+		}
+		// Variants whose compression does not pay off are not stored (see workList).
+		if action != planSkip && sf.uncompressed != "" && sf.isVariant() {
+			action, reason = planDelete, "compression does not pay off"
+			if reasons[fname] == "headers changed" {
+				action, reason = planSkip, "not stored"
+			}
+		}
+
+		pa := planAction{Key: fname, Action: action, Reason: reason, Headers: sf.hdrs, Compression: sf.hdrs[ContentEncoding]}
+		if sf.precompressed != "" {
+			pa.Compression += " (precompressed)"
+		} else if sf.uncompressed != "" {
+			pa.Compression = sf.uncompressed
+		}
+		if fi, err := os.Stat(sf.fpath); err == nil {
+			pa.Size = fi.Size()
+		}
+		actions = append(actions, pa)
+	}
+
+	reason := "removed locally"
+	if opts.Mirror {
+		reason = "missing locally"
+	}
+	for _, fname := range removed {
+		actions = append(actions, planAction{Key: fname, Action: planDelete, Reason: reason})
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Key < actions[j].Key
+	})
+
+	return
+}
+
+// printPlan writes the actions to w, either as JSON (all of them) or as a table (all but the
+// skipped ones) followed by a summary.
+func printPlan(w io.Writer, actions []planAction, format string) (err error) {
+	if format == planJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(actions)
+	}
+
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tKEY\tSIZE\tCOMPRESSION\tREASON")
+	for _, pa := range actions {
+		counts[pa.Action]++
+		if pa.Action == planSkip {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", pa.Action, pa.Key, pa.Size, pa.Compression, pa.Reason)
+	}
+	if err = tw.Flush(); err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(w, "\n%d to upload, %d to update headers, %d to delete, %d unchanged.\n",
+		counts[planUpload], counts[planUpdate], counts[planDelete], counts[planSkip])
+
+	return
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/alexaandru/utils"
+)
+
+func testPlan() []planAction {
+	current := utils.FileHashes{"foobar.html": "01677e4c0ae5468b9b8b823487f14524", "barbaz.txt": "dac2e8bd758efb58a30f9fcd7ac28b1b"}
+	old := utils.FileHashes{"barbaz.txt": "dac2e8bd758efb58a30f9fcd7ac28b1b+00000000", "old.txt": "1"}
+
+	return plan(current, old, []string{"foobar.html"}, []string{"barbaz.txt"}, []string{"old.txt"})
+}
+
+func TestPlan(t *testing.T) {
+	actions := testPlan()
+	if len(actions) != 3 {
+		t.Fatal("Expected an action for each file, got", actions)
+	}
+
+	expected := []planAction{
+		{Key: "barbaz.txt", Action: planUpdate, Reason: "headers changed"},
+		{Key: "foobar.html", Action: planUpload, Reason: "new file", Compression: "gzip"},
+		{Key: "old.txt", Action: planDelete, Reason: "removed locally"},
+	}
+	for i, pa := range actions {
+		if pa.Key != expected[i].Key || pa.Action != expected[i].Action || pa.Reason != expected[i].Reason || pa.Compression != expected[i].Compression {
+			t.Errorf("Expected %v got %v", expected[i], pa)
+		}
+	}
+	if actions[1].Size == 0 || actions[1].Headers[CacheControl] != "max-age=3600" {
+		t.Error("Expected the size and headers to be resolved, got", actions[1])
+	}
+
+	current := utils.FileHashes{"foobar.html": "2"}
+	old := utils.FileHashes{"foobar.html": "1+00000000+gzip"}
+	if actions = plan(current, old, nil, nil, nil); actions[0].Action != planSkip || actions[0].Reason != "unchanged" {
+		t.Error("Expected unchanged files to be skipped, got", actions)
+	}
+	if actions = plan(current, old, []string{"foobar.html"}, nil, nil); actions[0].Reason != "content changed" {
+		t.Error("Expected a content change, got", actions)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := printPlan(buf, testPlan(), planTable); err != nil {
+		t.Fatal("Expected the plan to be printed, got", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 6 || !strings.HasPrefix(lines[2], "upload          foobar.html") ||
+		lines[5] != "1 to upload, 1 to update headers, 1 to delete, 0 unchanged." {
+		t.Errorf("Unexpected table:\n%s", buf)
+	}
+
+	buf.Reset()
+	if err := printPlan(buf, testPlan(), planJSON); err != nil {
+		t.Fatal("Expected the plan to be printed, got", err)
+	}
+	actions := []planAction{}
+	if err := json.Unmarshal(buf.Bytes(), &actions); err != nil || len(actions) != 3 || actions[2].Action != planDelete {
+		t.Error("Expected the plan to round trip as JSON, got", actions, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the progress bar is redrawn.
+var progressInterval = 200 * time.Millisecond
+
+// width of the bar itself, in characters.
+const progressWidth = 20
+
+// progressBar periodically draws the progress of the uploads, on a single (terminal) line, out of
+// the counters of the run report, as updated by the workers.
+type progressBar struct {
+	w          io.Writer
+	r          *runReport
+	totalFiles int
+	totalBytes int64
+	started    time.Time
+	stopped    chan struct{}
+	wg         sync.WaitGroup
+}
+
+// progressBarEnabled tells whether the progress bar is to be shown: only in the default (human,
+// neither verbose nor quiet) mode, when actually uploading to a terminal.
+func progressBarEnabled(opts *options) bool {
+	return opts.progress && isTerminal(os.Stdout) && opts.LogFormat == logHuman &&
+		!opts.verbose && !opts.quiet && !opts.dryRun
+}
+
+// isTerminal tells whether f is a terminal (character device).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgressBar starts drawing the progress towards totalFiles files (totalBytes bytes) to w.
+func startProgressBar(w io.Writer, r *runReport, totalFiles int, totalBytes int64) (p *progressBar) {
+	p = &progressBar{w: w, r: r, totalFiles: totalFiles, totalBytes: totalBytes, started: time.Now(), stopped: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = io.WriteString(p.w, p.render(time.Now()))
+			case <-p.stopped:
+				_, _ = io.WriteString(p.w, p.render(time.Now())+"\n")
+				return
+			}
+		}
+	}()
+
+	return
+}
+
+// stop draws the progress one last time and stops. It is a no-op on a nil progressBar.
+func (p *progressBar) stop() {
+	if p == nil {
+		return
+	}
+
+	close(p.stopped)
+	p.wg.Wait()
+}
+
+// render returns the progress line (starting with a carriage return, so that it overwrites the
+// previous one): files and bytes done, throughput, retries and ETA.
+func (p *progressBar) render(now time.Time) string {
+	p.r.Lock()
+	files := p.r.Uploaded + p.r.Updated + p.r.Deleted + len(p.r.Rejected)
+	bytes, retries := p.r.BytesOriginal, p.r.Retried
+	p.r.Unlock()
+
+	elapsed := now.Sub(p.started).Seconds()
+	throughput, eta := 0.0, "-"
+	if elapsed > 0 {
+		throughput = float64(bytes) / elapsed
+	}
+	if files > 0 && files < p.totalFiles {
+		left := elapsed * float64(p.totalFiles-files) / float64(files)
+		if bytes > 0 && p.totalBytes > bytes {
+			left = float64(p.totalBytes-bytes) / throughput
+		}
+		eta = (time.Duration(left) * time.Second).String()
+	} else if files >= p.totalFiles {
+		eta = "0s"
+	}
+
+	done := progressWidth
+	if p.totalFiles > 0 {
+		done = progressWidth * files / p.totalFiles
+	}
+
+	return fmt.Sprintf("\r[%s%s] %d/%d files, %s/%s, %s/s, %d retries, ETA %s\033[K",
+		strings.Repeat("#", done), strings.Repeat("-", progressWidth-done), files, p.totalFiles,
+		humanBytes(bytes), humanBytes(p.totalBytes), humanBytes(int64(throughput)), retries, eta)
+}
+
+// humanBytes formats n bytes using the binary (KiB, MiB, etc.) units.
+func humanBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f, i = f/1024, i+1
+	}
+
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressBarRender(t *testing.T) {
+	r := newRunReport()
+	r.Uploaded, r.Deleted, r.Retried, r.BytesOriginal = 1, 2, 3, 2048
+	r.Rejected = append(r.Rejected, rejection{Key: "foobar.html"})
+
+	p := &progressBar{r: r, totalFiles: 8, totalBytes: 4096, started: time.Now()}
+	line := p.render(p.started.Add(2 * time.Second))
+	expected := "\r[##########----------] 4/8 files, 2.0 KiB/4.0 KiB, 1.0 KiB/s, 3 retries, ETA 2s\033[K"
+	if line != expected {
+		t.Errorf("Expected %q got %q", expected, line)
+	}
+
+	r.Uploaded = 5
+	if line = p.render(p.started.Add(4 * time.Second)); !strings.Contains(line, "8/8 files") || !strings.HasSuffix(line, "ETA 0s\033[K") {
+		t.Error("Expected the progress to be complete, got", line)
+	}
+}
+
+func TestProgressBarStartStop(t *testing.T) {
+	buf := &bytes.Buffer{}
+	p := startProgressBar(buf, newRunReport(), 2, 0)
+	p.stop()
+	if out := buf.String(); !strings.HasPrefix(out, "\r[") || !strings.HasSuffix(out, "\n") {
+		t.Error("Expected the progress to be drawn once stopped, got", out)
+	}
+
+	var nilBar *progressBar
+	nilBar.stop()
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 20: "5.0 MiB", 3 << 40: "3.0 TiB"}
+	for n, expected := range tests {
+		if actual := humanBytes(n); actual != expected {
+			t.Errorf("Expected %d to be %s got %s", n, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/alexaandru/utils"
+)
+
+// metaHash is the user metadata (x-amz-meta-go3up-md5) holding the md5 of the original
+// (uncompressed) content of a file.
+const metaHash = "Go3up-Md5"
+
+// remoteFile holds the details of a stored file. Listings only fill in the key, etag and size,
+// the (go3up) hash and headers are only known after a head call.
+type remoteFile struct {
+	key, etag, hash string
+	size            int64
+	hdrs            headers
+}
+
+// plainMD5 tells if the ETag of the file is the md5 of its (stored) content, which is not
+// the case for multipart uploads.
+func (r remoteFile) plainMD5() bool {
+	return len(r.etag) == 32 && !strings.Contains(r.etag, "-")
+}
+
+// remoteHashes builds the remote files list, with hashes comparable to the local (current) ones.
+// The ETag is used whenever it is the md5 of the content as found locally, otherwise the hash
+// is fetched from the file metadata, via the head func. Files missing locally only need to be
+// present in the list, their hash is irrelevant.
+func remoteHashes(ctx context.Context, current utils.FileHashes, objects []remoteFile, head func(context.Context, string) (remoteFile, error)) (hashes utils.FileHashes, err error) {
+	hashes, pending := utils.FileHashes{}, []string{}
+	for _, obj := range objects {
+		hash, ok := current[obj.key]
+		if !ok {
+			hashes[obj.key] = obj.etag
+			continue
+		}
+		if !obj.plainMD5() || newSourceFile(obj.key).encoding != "" {
+			pending = append(pending, obj.key)
+			continue
+		}
+
+		// The local hash ignores leading/trailing new lines (see utils.FileHashesNew) so it cannot
+		// be compared with the ETag directly, the md5 of the whole local file is used instead.
+		hashes[obj.key] = obj.etag
+		if sum, err2 := md5File(localPath(obj.key)); err2 == nil && sum == obj.etag {
+			hashes[obj.key] = hash
+		}
+	}
+
+	keys, m, wg := make(chan string), sync.Mutex{}, sync.WaitGroup{}
+	wg.Add(opts.WorkersCount)
+	for i := 0; i < opts.WorkersCount; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				r, err2 := head(ctx, key)
+				m.Lock()
+				if err2 != nil && err == nil {
+					err = err2
+				}
+				hashes[key] = r.hash
+				m.Unlock()
+			}
+		}()
+	}
+	for _, key := range pending {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	return
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/alexaandru/utils"
+)
+
+func TestRemoteFilePlainMD5(t *testing.T) {
+	if r := (remoteFile{etag: "01677e4c0ae5468b9b8b823487f14524"}); !r.plainMD5() {
+		t.Errorf("Expected %s to be a plain md5", r.etag)
+	}
+
+	if r := (remoteFile{etag: "01677e4c0ae5468b9b8b823487f14524-2"}); r.plainMD5() {
+		t.Errorf("Expected %s (multipart) NOT to be a plain md5", r.etag)
+	}
+}
+
+func TestRemoteHashes(t *testing.T) {
+	current := utils.FileHashes{"barbaz.txt": "1", "foobar.html": "2", "big.txt": "3", "changed.txt": "5"}
+	objects := []remoteFile{
+		{key: "barbaz.txt", etag: "b6652a32e3a09e8f279f4cc1f794ba00"},
+		{key: "changed.txt", etag: "55555555555555555555555555555555"},
+		{key: "foobar.html", etag: "22222222222222222222222222222222"},
+		{key: "big.txt", etag: "33333333333333333333333333333333-2"},
+		{key: "gone.html", etag: "44444444444444444444444444444444"},
+	}
+
+	heads, m := map[string]bool{}, sync.Mutex{}
+	head := func(_ context.Context, key string) (remoteFile, error) {
+		m.Lock()
+		heads[key] = true
+		m.Unlock()
+		return remoteFile{key: key, hash: "meta-" + key}, nil
+	}
+
+	hashes, err := remoteHashes(context.Background(), current, objects, head)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+
+	expected := utils.FileHashes{
+		"barbaz.txt":  "1",
+		"changed.txt": "55555555555555555555555555555555",
+		"foobar.html": "meta-foobar.html",
+		"big.txt":     "meta-big.txt",
+		"gone.html":   "44444444444444444444444444444444",
+	}
+	if len(hashes) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, hashes)
+	}
+	for k, v := range expected {
+		if hashes[k] != v {
+			t.Errorf("Expected %s to have hash %s got %s", k, v, hashes[k])
+		}
+	}
+
+	if len(heads) != 2 || !heads["foobar.html"] || !heads["big.txt"] {
+		t.Error("Expected metadata to be fetched only for compressed and multipart files, got", heads)
+	}
+}
+
+func TestRemoteHashesError(t *testing.T) {
+	current := utils.FileHashes{"foobar.html": "2"}
+	objects := []remoteFile{{key: "foobar.html", etag: "22222222222222222222222222222222"}}
+
+	_, err := remoteHashes(context.Background(), current, objects, func(context.Context, string) (remoteFile, error) {
+		return remoteFile{}, errors.New("Access Denied")
+	})
+	if err == nil {
+		t.Error("Expected the metadata fetching error to be returned")
+	}
+}
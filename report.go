@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runReport holds the outcome of a run, saved (as JSON) to the file given with -report.
+type runReport struct {
+	Started, Finished time.Time
+	// Files found locally and files to be uploaded, updated or deleted.
+	Scanned, Diffed            int
+	Uploaded, Updated, Deleted int
+	Retried                    int
+	Rejected                   []rejection
+	// Files uploaded uncompressed (variants left out), as compressing them did not pay off.
+	Uncompressed []uncompressed
+	// Bytes of the uploaded files, before and after compression.
+	BytesOriginal, BytesStored int64
+	ExitCode                   int
+	sync.Mutex
+}
+
+// rejection describes a file that could not be uploaded (updated, deleted).
+type rejection struct {
+	Key, Action, Error string
+	Attempts           int
+}
+
+// uncompressed describes a file uploaded uncompressed, despite its rule, and why.
+type uncompressed struct {
+	Key, Reason string
+}
+
+// report of the current run.
+var report = newRunReport()
+
+func newRunReport() *runReport {
+	return &runReport{Started: time.Now(), Rejected: []rejection{}, Uncompressed: []uncompressed{}}
+}
+
+// done records the src work as successfully completed.
+func (r *runReport) done(src *sourceFile) {
+	r.Lock()
+	defer r.Unlock()
+
+	switch src.action {
+	case actionUpload:
+		r.Uploaded++
+		r.BytesOriginal += src.size
+		r.BytesStored += src.storedSize()
+	case actionUpdate:
+		r.Updated++
+	case actionDelete:
+		r.Deleted += len(src.deletes)
+	}
+	if src.uncompressed != "" {
+		r.Uncompressed = append(r.Uncompressed, uncompressed{src.fname, src.uncompressed})
+	}
+}
+
+// retried records a retry of the src work.
+func (r *runReport) retried(src *sourceFile) {
+	r.Lock()
+	r.Retried++
+	r.Unlock()
+}
+
+// rejected records the src work as rejected, due to err.
+func (r *runReport) rejected(src *sourceFile, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, key := range src.keys() {
+		r.Rejected = append(r.Rejected, rejection{Key: key, Action: src.action, Error: err.Error(), Attempts: src.attempts})
+	}
+}
+
+// dump saves the report, as JSON, to fname.
+func (r *runReport) dump(fname string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.Finished = time.Now()
+
+	return writeFileAtomic(fname, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	})
+}
+
+// printRejected writes the list of rejected files, sorted by key, along with their last error.
+func printRejected(w io.Writer, rejected []rejection) {
+	sorted := append([]rejection{}, rejected...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	fmt.Fprintf(w, "%d file(s) failed, they will be retried on the next run:\n", len(sorted))
+	for _, rj := range sorted {
+		fmt.Fprintf(w, "  %s %s (%d attempt(s)): %s\n", rj.Action, rj.Key, rj.Attempts, rj.Error)
+	}
+}
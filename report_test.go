@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunReport(t *testing.T) {
+	r := newRunReport()
+
+	sf := newSourceFile("foobar.html")
+	body, err := sf.body()
+	if err != nil {
+		t.Fatal("Expected body to succeed, got", err)
+	}
+	_, _ = ioutil.ReadAll(body)
+	_ = body.Close()
+	r.done(sf)
+	r.done(newDeleteBatch([]string{"a.html", "b.html"}))
+
+	failed := newDeleteBatch([]string{"c.html", "d.html"})
+	failed.recordAttempt()
+	r.retried(failed)
+	r.rejected(failed, errors.New("access denied"))
+
+	if r.Uploaded != 1 || r.Deleted != 2 || r.Retried != 1 || len(r.Rejected) != 2 {
+		t.Error("Expected the outcome to be recorded, got", r)
+	}
+	if fi, _ := os.Stat(sf.fpath); r.BytesOriginal != fi.Size() || r.BytesStored == 0 || r.BytesStored == r.BytesOriginal {
+		t.Error("Expected the bytes before and after compression to be recorded, got", r.BytesOriginal, r.BytesStored)
+	}
+	if len(r.Uncompressed) != 0 {
+		t.Error("Expected no uncompressed files, got", r.Uncompressed)
+	}
+	if rj := r.Rejected[1]; rj.Key != "d.html" || rj.Action != actionDelete || rj.Error != "access denied" || rj.Attempts != 1 {
+		t.Error("Expected the rejection details to be recorded, got", rj)
+	}
+
+	r2 := newRunReport()
+	sf.uncompressed = "gzip skipped"
+	r2.done(sf)
+	if u := r2.Uncompressed; len(u) != 1 || u[0].Key != "foobar.html" || u[0].Reason != "gzip skipped" {
+		t.Error("Expected the compression decision to be recorded, got", u)
+	}
+
+	dir, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the temp folder:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "report.json")
+	if err = r.dump(fname); err != nil {
+		t.Fatal("Expected the report to be saved, got", err)
+	}
+	data, _ := ioutil.ReadFile(fname)
+	saved := runReport{}
+	if err = json.Unmarshal(data, &saved); err != nil || saved.Uploaded != 1 || len(saved.Rejected) != 2 || saved.Finished.Before(saved.Started) {
+		t.Error("Expected the report to round trip as JSON, got", string(data), err)
+	}
+}
+
+func TestPrintRejected(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printRejected(buf, []rejection{
+		{Key: "foobar.html", Action: actionUpload, Error: "access denied", Attempts: 1},
+		{Key: "barbaz.txt", Action: actionDelete, Error: "EOF", Attempts: 10},
+	})
+
+	expected := "2 file(s) failed, they will be retried on the next run:\n" +
+		"  delete barbaz.txt (10 attempt(s)): EOF\n" +
+		"  upload foobar.html (1 attempt(s)): access denied\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+}
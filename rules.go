@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// headerRule is the config file representation of a pathToHeaders rule.
+// Pattern is a regular expression matched against the file (remote) key, including the destination
+// prefix, if any (i.e. "docs/index.html" under -prefix docs), so anchor it with care.
+type headerRule struct {
+	Pattern            string
+	CacheControl       string   `json:",omitempty"`
+	ContentEncoding    string   `json:",omitempty"`
+	ContentType        string   `json:",omitempty"`
+	ContentDisposition string   `json:",omitempty"`
+	ContentLanguage    string   `json:",omitempty"`
+	CompressionLevel   int      `json:",omitempty"`
+	Variants           []string `json:",omitempty"`
+}
+
+// headers returns the headers set by the rule.
+func (hr headerRule) headers() (hdrs headers) {
+	hdrs = headers{}
+	encoding := hr.ContentEncoding
+	if encoding == identity {
+		encoding = ""
+	}
+	for hdr, val := range map[string]string{
+		CacheControl:       hr.CacheControl,
+		ContentEncoding:    encoding,
+		ContentType:        hr.ContentType,
+		ContentDisposition: hr.ContentDisposition,
+		ContentLanguage:    hr.ContentLanguage,
+	} {
+		if val != "" {
+			hdrs[hdr] = val
+		}
+	}
+
+	return
+}
+
+// compileRules validates the rules and turns them into pathToHeaders, preserving their order.
+func compileRules(rules []headerRule) (out []pathToHeaders, err error) {
+	for i, rule := range rules {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("header rule #%d: pattern is missing", i+1)
+		}
+
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("header rule #%d: invalid pattern %q: %v", i+1, rule.Pattern, err)
+		}
+
+		if err = validateCompression(rule); err != nil {
+			return nil, fmt.Errorf("header rule #%d (%q): %v", i+1, rule.Pattern, err)
+		}
+
+		out = append(out, pathToHeaders{re, rule.headers(), compression{rule.CompressionLevel, rule.Variants}})
+	}
+
+	return
+}
+
+// validateCompression checks the rule encoding, variants and compression level, which applies to
+// all of them, so it can be given for the variants alone too.
+func validateCompression(rule headerRule) (err error) {
+	level := rule.CompressionLevel
+	if len(rule.Variants) > 0 && (rule.ContentEncoding == "" || rule.ContentEncoding == identity) {
+		level = defaultLevel
+	}
+	if err = validateEncoding(rule.ContentEncoding, level); err != nil {
+		return
+	}
+
+	for _, enc := range rule.Variants {
+		if enc == "" || enc == identity {
+			return fmt.Errorf("variants must be compressed, got %q", enc)
+		}
+		if err = validateEncoding(enc, rule.CompressionLevel); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// loadRules reads a list of header rules from a JSON file.
+func loadRules(fname string) (rules []headerRule, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if err = json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("header rules file %s: %v", fname, err)
+	}
+
+	return
+}
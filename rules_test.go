@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderRuleHeaders(t *testing.T) {
+	rule := headerRule{Pattern: "\\.html$", CacheControl: "max-age=60", ContentEncoding: "gzip", ContentLanguage: "ro"}
+	expected := headers{CacheControl: "max-age=60", ContentEncoding: "gzip", ContentLanguage: "ro"}
+
+	if actual := rule.headers(); !actual.equal(expected) {
+		t.Errorf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	rules := []headerRule{
+		{Pattern: "index\\.html$", CacheControl: "max-age=60"},
+		{Pattern: "\\.json$", ContentType: "application/vnd.api+json"},
+		{Pattern: "\\.js$", ContentEncoding: "br", CompressionLevel: 11},
+		{Pattern: "\\.txt$", ContentEncoding: identity},
+		{Pattern: "\\.css$", CompressionLevel: 9, Variants: []string{"br", "gzip"}},
+	}
+
+	compiled, err := compileRules(rules)
+	if err != nil {
+		t.Fatal("Expected rules to compile, got", err)
+	}
+	if len(compiled) != 5 || !compiled[0].pathPattern.MatchString("foo/index.html") {
+		t.Fatal("Expected rules to be compiled in order, got", compiled)
+	}
+	if ct := compiled[1].headers[ContentType]; ct != "application/vnd.api+json" {
+		t.Error("Expected Content-Type override to be kept, got", ct)
+	}
+	if compiled[2].headers[ContentEncoding] != "br" || compiled[2].level != 11 {
+		t.Error("Expected the encoding and its level to be kept, got", compiled[2])
+	}
+	if enc, ok := compiled[3].headers[ContentEncoding]; ok {
+		t.Error("Expected the identity encoding to be left out, got", enc)
+	}
+	if v := compiled[4].variants; len(v) != 2 || v[0] != "br" || compiled[4].level != 9 {
+		t.Error("Expected the variants and their level to be kept, got", compiled[4])
+	}
+
+	tests := map[string]headerRule{
+		"pattern is missing":                       {CacheControl: "max-age=60"},
+		"invalid pattern":                          {Pattern: "articole.*(\\.html"},
+		"unsupported content encoding":             {Pattern: "\\.html$", ContentEncoding: "deflate"},
+		"out of the 1-22 range":                    {Pattern: "\\.html$", ContentEncoding: "zstd", CompressionLevel: 23},
+		"without a content encoding":               {Pattern: "\\.html$", CompressionLevel: 5},
+		"variants must be compressed":              {Pattern: "\\.html$", Variants: []string{"gzip", identity}},
+		"unsupported content encoding \"deflate\"": {Pattern: "\\.html$", Variants: []string{"deflate"}},
+		"out of the 1-9 range":                     {Pattern: "\\.html$", CompressionLevel: 11, Variants: []string{"br", "gzip"}},
+	}
+	for expected, rule := range tests {
+		_, err := compileRules([]headerRule{{Pattern: "\\.css$"}, rule})
+		if err == nil || !strings.Contains(err.Error(), expected) || !strings.HasPrefix(err.Error(), "header rule #2") {
+			t.Errorf("Expected error about %q for rule #2, got %v", expected, err)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := loadRules("test/rules.json")
+	if err != nil {
+		t.Fatal("Expected rules to load, got", err)
+	}
+	if len(rules) != 2 || rules[0].Pattern != "\\.html$" || rules[1].CacheControl != "max-age=31536000" {
+		t.Error("Rules do not match expectation, got", rules)
+	}
+
+	if _, err = loadRules("test/bogus.json"); err == nil {
+		t.Error("Expected loading a missing rules file to fail")
+	}
+}
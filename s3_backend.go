@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Backend stores the files in an S3 bucket.
+type s3Backend struct {
+	bucket string
+	svc    *s3.S3
+}
+
+func (b *s3Backend) String() string {
+	return b.bucket
+}
+
+func (b *s3Backend) put(ctx context.Context, src *sourceFile) (err error) {
+	body, err := src.body()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	u := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.S3 = b.svc
+		u.LeavePartsOnError = false
+	})
+	_, err = u.UploadWithContext(ctx, &s3manager.UploadInput{
+		Key:                  &src.fname,
+		Body:                 body,
+		Bucket:               &b.bucket,
+		ContentType:          src.getHeader(ContentType),
+		ContentEncoding:      src.getHeader(ContentEncoding),
+		ContentDisposition:   src.getHeader(ContentDisposition),
+		ContentLanguage:      src.getHeader(ContentLanguage),
+		CacheControl:         src.getHeader(CacheControl),
+		ServerSideEncryption: src.getHeader(Encryption),
+		Metadata:             src.metadata(),
+	})
+
+	return
+}
+
+// update copies the remote file onto itself, replacing its headers with the ones of src.
+func (b *s3Backend) update(ctx context.Context, src *sourceFile) error {
+	_, err := b.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:               &b.bucket,
+		Key:                  &src.fname,
+		CopySource:           aws.String(copySource(b.bucket, src.fname)),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		ContentType:          src.getHeader(ContentType),
+		ContentEncoding:      src.getHeader(ContentEncoding),
+		ContentDisposition:   src.getHeader(ContentDisposition),
+		ContentLanguage:      src.getHeader(ContentLanguage),
+		CacheControl:         src.getHeader(CacheControl),
+		ServerSideEncryption: src.getHeader(Encryption),
+		Metadata:             src.metadata(),
+	})
+
+	return err
+}
+
+// delete removes the files with a single DeleteObjects call, so fnames must not hold
+// more than maxDeleteBatch files.
+func (b *s3Backend) delete(ctx context.Context, fnames []string) (failed []string, err error) {
+	objects := make([]*s3.ObjectIdentifier, len(fnames))
+	for i, fname := range fnames {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(fname)}
+	}
+
+	out, err := b.svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: &b.bucket,
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return fnames, err
+	}
+	if len(out.Errors) == 0 {
+		return
+	}
+
+	failed = make([]string, len(out.Errors))
+	for i, e := range out.Errors {
+		failed[i] = aws.StringValue(e.Key)
+	}
+
+	return failed, fmt.Errorf("%d file(s) could not be deleted, first error: %s", len(failed), aws.StringValue(out.Errors[0].Message))
+}
+
+func (b *s3Backend) list(ctx context.Context, prefix string) (objects []remoteFile, err error) {
+	input := &s3.ListObjectsV2Input{Bucket: &b.bucket}
+	if prefix != "" {
+		input.Prefix = &prefix
+	}
+	err = b.svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, remoteFile{
+				key:  aws.StringValue(obj.Key),
+				etag: strings.Trim(aws.StringValue(obj.ETag), `"`),
+				size: aws.Int64Value(obj.Size),
+			})
+		}
+		return true
+	})
+
+	return
+}
+
+func (b *s3Backend) head(ctx context.Context, fname string) (r remoteFile, err error) {
+	out, err := b.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &b.bucket, Key: &fname})
+	if err != nil {
+		return
+	}
+
+	r = remoteFile{
+		key:  fname,
+		etag: strings.Trim(aws.StringValue(out.ETag), `"`),
+		size: aws.Int64Value(out.ContentLength),
+		hdrs: headers{},
+	}
+	for hdr, val := range map[string]*string{
+		ContentType:        out.ContentType,
+		ContentEncoding:    out.ContentEncoding,
+		ContentDisposition: out.ContentDisposition,
+		ContentLanguage:    out.ContentLanguage,
+		CacheControl:       out.CacheControl,
+	} {
+		if val != nil {
+			r.hdrs[hdr] = *val
+		}
+	}
+	for k, v := range out.Metadata {
+		if strings.EqualFold(k, metaHash) {
+			r.hash = aws.StringValue(v)
+		}
+	}
+
+	return
+}
+
+// create relies on the S3 conditional writes (If-None-Match/If-Match on PutObject).
+func (b *s3Backend) create(ctx context.Context, fname string, data []byte, etag string) (err error) {
+	req, _ := b.svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: &b.bucket,
+		Key:    &fname,
+		Body:   bytes.NewReader(data),
+	})
+	req.SetContext(ctx)
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", `"`+etag+`"`)
+	}
+
+	err = req.Send()
+	if e, ok := err.(awserr.RequestFailure); ok && (e.StatusCode() == http.StatusPreconditionFailed ||
+		e.StatusCode() == http.StatusConflict || (etag != "" && e.StatusCode() == http.StatusNotFound)) {
+		return errPreconditionFailed
+	}
+
+	return
+}
+
+func (b *s3Backend) get(ctx context.Context, fname string) (data []byte, etag string, err error) {
+	out, err := b.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: &b.bucket, Key: &fname})
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+		return nil, "", errNotFound
+	} else if err != nil {
+		return
+	}
+	defer func() {
+		_ = out.Body.Close()
+	}()
+
+	if data, err = ioutil.ReadAll(out.Body); err != nil {
+		return
+	}
+
+	return data, strings.Trim(aws.StringValue(out.ETag), `"`), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is a minimal, in memory, S3 compatible server: just enough of the API (path style only)
+// for exercising the s3Backend. Listings are paginated, pageSize keys per page. Objects are served
+// as stored, with no headers, so GET is only meant for the ones stored via create.
+type fakeS3 struct {
+	objects  map[string]fakeObject
+	pageSize int
+	sync.Mutex
+}
+
+type fakeObject struct {
+	body []byte
+	hdrs http.Header
+}
+
+// stored headers, the x-amz-meta-* ones are stored too.
+var fakeS3Headers = []string{ContentType, ContentEncoding, CacheControl, ContentDisposition, ContentLanguage}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	parts := append(strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2), "")
+	key, q := parts[1], req.URL.Query()
+	switch {
+	case req.Method == http.MethodGet && key == "":
+		f.list(w, q.Get("prefix"), q.Get("continuation-token"))
+	case req.Method == http.MethodPost && key == "":
+		f.delete(w, req)
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		obj, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		f.objects[key] = fakeObject{obj.body, f.headers(req)}
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%q</ETag></CopyObjectResult>", etag(obj.body))
+	case req.Method == http.MethodPut:
+		obj, ok := f.objects[key]
+		if (req.Header.Get("If-None-Match") == "*" && ok) ||
+			(req.Header.Get("If-Match") != "" && (!ok || req.Header.Get("If-Match") != strconv.Quote(etag(obj.body)))) {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		f.objects[key] = fakeObject{body, f.headers(req)}
+		w.Header().Set("ETag", strconv.Quote(etag(body)))
+	case req.Method == http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", strconv.Quote(etag(obj.body)))
+		_, _ = w.Write(obj.body)
+	case req.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.hdrs {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", strconv.Quote(etag(obj.body)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) headers(req *http.Request) http.Header {
+	hdrs := http.Header{}
+	for k, v := range req.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			hdrs[k] = v
+		}
+	}
+	for _, k := range fakeS3Headers {
+		if v := req.Header.Get(k); v != "" {
+			hdrs.Set(k, v)
+		}
+	}
+
+	return hdrs
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, from string) {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key >= from {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	next := ""
+	if len(keys) > f.pageSize {
+		keys, next = keys[:f.pageSize], keys[f.pageSize]
+	}
+
+	fmt.Fprintf(w, "<ListBucketResult><KeyCount>%d</KeyCount><IsTruncated>%v</IsTruncated>", len(keys), next != "")
+	if next != "" {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", next)
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><ETag>%q</ETag><Size>%d</Size></Contents>",
+			key, etag(f.objects[key].body), len(f.objects[key].body))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) delete(w http.ResponseWriter, req *http.Request) {
+	input := struct {
+		Objects []struct{ Key string } `xml:"Object"`
+	}{}
+	if err := xml.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprint(w, "<DeleteResult>")
+	for _, obj := range input.Objects {
+		delete(f.objects, obj.Key)
+	}
+	fmt.Fprint(w, "</DeleteResult>")
+}
+
+func etag(body []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(body))
+}
+
+// newTestS3Backend returns an s3Backend talking to an S3 compatible endpoint: the one given by
+// GO3UP_TEST_ENDPOINT (and GO3UP_TEST_BUCKET), if set, or else an in memory fakeS3.
+func newTestS3Backend(t *testing.T) (b *s3Backend, cleanup func()) {
+	opts1 := &options{
+		Region:         "us-east-1",
+		Endpoint:       os.Getenv("GO3UP_TEST_ENDPOINT"),
+		ForcePathStyle: true,
+		DisableSSL:     true,
+	}
+	bucket, cleanup := os.Getenv("GO3UP_TEST_BUCKET"), func() {}
+	if opts1.Endpoint == "" {
+		srv := httptest.NewServer(&fakeS3{objects: map[string]fakeObject{}, pageSize: 1})
+		opts1.Endpoint, bucket, cleanup = srv.URL, "example_bucket", srv.Close
+	}
+
+	creds := credentials.NewEnvCredentials()
+	if _, err := creds.Get(); err != nil {
+		creds = credentials.NewStaticCredentials("secret", "secret", "")
+	}
+
+	return &s3Backend{bucket: bucket, svc: s3.New(sess, awsConfig(opts1, creds))}, cleanup
+}
+
+func TestAWSConfig(t *testing.T) {
+	opts1 := &options{Region: "us-west-1"}
+	if cfg := awsConfig(opts1, nil); cfg.Endpoint != nil || *cfg.S3ForcePathStyle || *cfg.DisableSSL {
+		t.Error("Expected the default AWS endpoint to be used, got", cfg)
+	}
+
+	opts1 = &options{Region: "us-west-1", Endpoint: "localhost:9000", ForcePathStyle: true, DisableSSL: true}
+	if cfg := awsConfig(opts1, nil); *cfg.Endpoint != "localhost:9000" || !*cfg.S3ForcePathStyle || !*cfg.DisableSSL {
+		t.Error("Expected the custom endpoint to be used, got", cfg)
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	b, cleanup := newTestS3Backend(t)
+	defer cleanup()
+
+	for _, fname := range []string{"foobar.html", "barbaz.txt"} {
+		sf := newSourceFile(fname)
+		sf.fname, sf.hash = "go3up-test/"+fname, "hash-"+fname
+		if err := b.put(context.Background(), sf); err != nil {
+			t.Fatal("Expected put to succeed, got", err)
+		}
+	}
+
+	objects, err := b.list(context.Background(), "go3up-test/")
+	if err != nil {
+		t.Fatal("Expected list to succeed, got", err)
+	}
+	if len(objects) != 2 || objects[0].key != "go3up-test/barbaz.txt" || objects[1].key != "go3up-test/foobar.html" {
+		t.Fatal("Expected all the (paginated) files to be listed, got", objects)
+	}
+
+	r, err := b.head(context.Background(), "go3up-test/foobar.html")
+	if err != nil {
+		t.Fatal("Expected head to succeed, got", err)
+	}
+	if r.hash != "hash-foobar.html" || r.hdrs[ContentEncoding] != "gzip" || r.hdrs[CacheControl] != "max-age=3600" {
+		t.Error("Expected the headers and hash to be stored, got", r)
+	}
+	if r.etag != objects[1].etag || r.size != objects[1].size {
+		t.Error("Expected head and list to agree, got", r, objects[1])
+	}
+
+	sf := newSourceFile("foobar.html")
+	sf.fname, sf.hdrs[CacheControl] = "go3up-test/foobar.html", "no-cache"
+	if err = b.update(context.Background(), sf); err != nil {
+		t.Fatal("Expected update to succeed, got", err)
+	}
+	if r, _ = b.head(context.Background(), sf.fname); r.hdrs[CacheControl] != "no-cache" || r.etag != objects[1].etag {
+		t.Error("Expected headers to be updated and content left untouched, got", r)
+	}
+
+	if failed, err := b.delete(context.Background(), []string{"go3up-test/foobar.html", "go3up-test/barbaz.txt"}); err != nil || len(failed) != 0 {
+		t.Fatal("Expected delete to succeed, got", failed, err)
+	}
+	if objects, _ = b.list(context.Background(), "go3up-test/"); len(objects) != 0 {
+		t.Error("Expected all files to be deleted, got", objects)
+	}
+}
+
+func TestS3BackendPutGzip(t *testing.T) {
+	b, cleanup := newTestS3Backend(t)
+	defer cleanup()
+
+	sf := newSourceFile("foobar.html")
+	sf.fname = "go3up-test/foobar.html"
+	if err := b.put(context.Background(), sf); err != nil {
+		t.Fatal("Expected put to succeed, got", err)
+	}
+	defer func() {
+		_, _ = b.delete(context.Background(), []string{sf.fname})
+	}()
+
+	body, err := sf.body()
+	if err != nil {
+		t.Fatal("Expected body to succeed, got", err)
+	}
+	defer body.Close()
+	compressed, _ := ioutil.ReadAll(body)
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal("Expected the content to be gzipped, got", err)
+	}
+	content, _ := ioutil.ReadAll(zr)
+	if original, _ := ioutil.ReadFile(sf.fpath); string(content) != string(original) {
+		t.Errorf("Expected compressed content to be %q got %q", original, content)
+	}
+
+	if r, err := b.head(context.Background(), sf.fname); err != nil || r.etag != etag(compressed) {
+		t.Error("Expected the compressed content to be stored, got", r, err)
+	}
+}
+
+func TestS3BackendCreate(t *testing.T) {
+	b, cleanup := newTestS3Backend(t)
+	defer cleanup()
+
+	testBackendCreate(t, b, "go3up-test/lock")
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"regexp"
 	"runtime"
@@ -17,14 +18,20 @@ import (
 )
 
 var opts = &options{
-	WorkersCount: runtime.NumCPU() * 2,
-	Source:       "output",
-	CacheFile:    ".go3up.txt",
-	doUpload:     true,
-	doCache:      true,
-	Region:       os.Getenv("AWS_DEFAULT_REGION"),
-	Profile:      os.Getenv("AWS_DEFAULT_PROFILE"),
-	cfgFile:      ".go3up.json",
+	WorkersCount:       runtime.NumCPU() * 2,
+	Source:             "output",
+	CacheFile:          ".go3up.txt",
+	doUpload:           true,
+	doCache:            true,
+	progress:           true,
+	Region:             os.Getenv("AWS_DEFAULT_REGION"),
+	Profile:            os.Getenv("AWS_DEFAULT_PROFILE"),
+	cfgFile:            ".go3up.json",
+	LogFormat:          logHuman,
+	planFormat:         planTable,
+	CheckpointEvery:    1000,
+	CheckpointInterval: 30,
+	LockTTL:            3600,
 }
 
 var appEnv string
@@ -34,37 +41,63 @@ var sess = session.New()
 
 var s3svc *s3.S3
 
-var say func(...string)
+// storage backend the files are uploaded to.
+var store backend
 
+var logger = newLogger(os.Stdout, logHuman, slog.LevelInfo)
+
+// Default header rules, used unless the user provides their own (see headerRule).
 // Order matters: first hit, first served.
-// TODO: Make this configurable somehow, so that end users can provide their own mappings.
 var r = regexp.MustCompile
 var customHeadersDef = []pathToHeaders{
-	{r("index\\.html"), headers{ContentEncoding: "gzip", CacheControl: "max-age=1800"}},       // 1800
-	{r("articole.*\\.html$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=3600"}}, // 86400
-	{r("[^/]*\\.html$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=3600"}},
-	{r("\\.xml$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=1800"}},
-	{r("\\.ico$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=31536000"}},
-	{r("\\.(js|css)$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=31536000"}},
-	{r("images/articole/.*(jpg|JPG|png|PNG)$"), headers{CacheControl: "max-age=31536000"}},
-	{r("\\.(jpg|JPG|png|PNG)$"), headers{CacheControl: "max-age=31536000"}},
+	{r("index\\.html"), headers{ContentEncoding: "gzip", CacheControl: "max-age=1800"}, compression{}},
+	{r("[^/]*\\.html$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=3600"}, compression{}},
+	{r("\\.xml$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=1800"}, compression{}},
+	{r("\\.ico$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=31536000"}, compression{}},
+	{r("\\.(js|css)$"), headers{ContentEncoding: "gzip", CacheControl: "max-age=31536000"}, compression{}},
+	{r("\\.(jpg|JPG|png|PNG)$"), headers{CacheControl: "max-age=31536000"}, compression{}},
 }
 
 // processCmdLineFlags wraps the command line flags handling.
 func processCmdLineFlags(opts *options) {
 	flag.IntVar(&opts.WorkersCount, "workers", opts.WorkersCount, "No. of workers to use for uploads")
 	flag.StringVar(&opts.BucketName, "bucket", opts.BucketName, "Bucket to upload files to")
+	flag.StringVar(&opts.Target, "target", opts.Target, "Local directory to upload files to, instead of the bucket (file:///some/path)")
 	flag.StringVar(&opts.Source, "source", opts.Source, "Source folder for files to be uploaded")
+	flag.StringVar(&opts.Prefix, "prefix", opts.Prefix, "Destination prefix (folder) in the bucket")
+	flag.Var(stringsFlag{&opts.Include}, "include", "Only upload files matching this (gitignore style) pattern (can be repeated)")
+	flag.Var(stringsFlag{&opts.Exclude}, "exclude", "Skip files matching this (gitignore style) pattern (can be repeated)")
 	flag.StringVar(&opts.CacheFile, "cachefile", opts.CacheFile, "Location of the cache file")
 	flag.StringVar(&opts.Region, "region", opts.Region, "AWS region")
 	flag.StringVar(&opts.Profile, "profile", opts.Profile, "AWS shared profile")
+	flag.StringVar(&opts.Endpoint, "endpoint", opts.Endpoint, "S3 compatible endpoint (i.e. MinIO, Ceph, R2) to use instead of AWS")
+	flag.BoolVar(&opts.ForcePathStyle, "force-path-style", opts.ForcePathStyle, "Use path style addressing (endpoint/bucket/key)")
+	flag.BoolVar(&opts.DisableSSL, "disable-ssl", opts.DisableSSL, "Use plain HTTP for talking to the endpoint")
+	flag.IntVar(&opts.CheckpointEvery, "checkpoint-every", opts.CheckpointEvery, "Save the cache every so many completed files (0 to disable)")
+	flag.IntVar(&opts.CheckpointInterval, "checkpoint-interval", opts.CheckpointInterval, "Save the cache every so many seconds (0 to disable)")
+	flag.BoolVar(&opts.Lock, "lock", opts.Lock, "Lock the bucket for the duration of the deploy, guarding against concurrent deploys")
+	flag.StringVar(&opts.LockHolder, "lock-holder", opts.LockHolder, "Name to record as the deploy lock holder (defaults to $USER)")
+	flag.IntVar(&opts.LockTTL, "lock-ttl", opts.LockTTL, "Seconds after which a deploy lock is considered stale and can be taken over")
+	flag.IntVar(&opts.LockWait, "lock-wait", opts.LockWait, "Seconds to wait for a deploy lock held by someone else to be released")
+	flag.BoolVar(&opts.forceUnlock, "force-unlock", opts.forceUnlock, "Remove the deploy lock, whoever holds it, and exit")
+	flag.Int64Var(&opts.CompressMinSize, "compress-min-size", opts.CompressMinSize, "Upload files smaller than this many bytes uncompressed")
+	flag.IntVar(&opts.CompressMinSavings, "compress-min-savings", opts.CompressMinSavings, "Upload files uncompressed unless compression saves at least this percentage")
 	flag.StringVar(&opts.cfgFile, "cfgfile", opts.cfgFile, "Config file location")
+	flag.StringVar(&opts.RulesFile, "rules", opts.RulesFile, "Header rules file location (overrides the rules in the config file)")
 	flag.BoolVar(&opts.dryRun, "dry", opts.dryRun, "Dry run (do not upload/update cache)")
+	flag.BoolVar(&opts.plan, "plan", opts.plan, "Print what would be uploaded, updated or deleted (and why), then exit")
+	flag.StringVar(&opts.planFormat, "plan-format", opts.planFormat, "Format of the plan: table or json")
 	flag.BoolVar(&opts.verbose, "verbose", opts.verbose, "Print the name of the files as they are uploaded")
 	flag.BoolVar(&opts.quiet, "quiet", opts.quiet, "Print only warnings and/or errors")
+	flag.BoolVar(&opts.progress, "progress", opts.progress, "Show a progress bar (only when printing to a terminal)")
+	flag.StringVar(&opts.LogFormat, "log-format", opts.LogFormat, "Log format: human (progress dots), text or json (on stderr)")
 	flag.BoolVar(&opts.doUpload, "upload", opts.doUpload, "Do perform an upload")
 	flag.BoolVar(&opts.doCache, "cache", opts.doCache, "Do update the cache")
 	flag.BoolVar(&opts.Encrypt, "encrypt", opts.Encrypt, "Encrypt files on server side")
+	flag.BoolVar(&opts.Delete, "delete", opts.Delete, "Delete remote files that were removed locally")
+	flag.BoolVar(&opts.Mirror, "mirror", opts.Mirror, "Compare against the bucket contents instead of the cache, and delete remote files missing locally")
+	flag.BoolVar(&opts.rebuildCache, "rebuild-cache", opts.rebuildCache, "Rebuild the cache file from the bucket contents (no upload)")
+	flag.StringVar(&opts.reportFile, "report", opts.reportFile, "Save a JSON report of the run to this file")
 	flag.BoolVar(&opts.saveCfg, "save", opts.saveCfg, "Saves the current commandline options to a config file")
 	flag.Parse()
 }
@@ -72,15 +105,41 @@ func processCmdLineFlags(opts *options) {
 // validateCmdLineFlags validates some of the flags, mostly paths. Defers actual validation to validateCmdLineFlag()
 func validateCmdLineFlags(opts *options) (err error) {
 	flags := map[string]string{
-		"Bucket Name": opts.BucketName,
-		"Source":      opts.Source,
-		"Cache file":  opts.CacheFile,
+		"Cache file": opts.CacheFile,
+	}
+	// Mappings take precedence over the Source.
+	if len(opts.Mappings) == 0 {
+		flags["Source"] = opts.Source
+	}
+	if opts.plan {
+		flags["Plan format"] = opts.planFormat
+	}
+	if opts.LogFormat != "" {
+		flags["Log format"] = opts.LogFormat
+	}
+	if opts.Target == "" {
+		flags["Bucket Name"] = opts.BucketName
+	} else {
+		flags["Target"] = opts.Target
 	}
 	for label, val := range flags {
 		if err = validateCmdLineFlag(label, val); err != nil {
 			return
 		}
 	}
+	for i, m := range opts.Mappings {
+		if err = validateCmdLineFlag(fmt.Sprintf("Mapping #%d source", i+1), m.Source); err != nil {
+			return
+		}
+	}
+	for _, m := range opts.mappings() {
+		if _, err = newFileFilter(m.Source, opts.Include, opts.Exclude); err != nil {
+			return
+		}
+	}
+	if opts.CompressMinSize < 0 || opts.CompressMinSavings < 0 || opts.CompressMinSavings > 100 {
+		return errors.New("Compression thresholds must be a positive size and a 0-100 percentage")
+	}
 	return
 }
 
@@ -91,12 +150,56 @@ func validateCmdLineFlag(label, val string) (err error) {
 		if val == "" {
 			return errors.New(label + " is not set")
 		}
+	case "Target":
+		_, err = newBackend(val)
+	case "Log format":
+		if val != logHuman && val != logText && val != logJSON {
+			return fmt.Errorf("%s must be %s, %s or %s", label, logHuman, logText, logJSON)
+		}
+	case "Plan format":
+		if val != planTable && val != planJSON {
+			return fmt.Errorf("%s must be %s or %s", label, planTable, planJSON)
+		}
 	default:
 		_, err = os.Stat(val)
 	}
 	return
 }
 
+// initHeaderRules replaces the default header rules with the user provided ones, if any.
+func initHeaderRules(opts *options) (err error) {
+	rules := opts.Rules
+	if opts.RulesFile != "" {
+		if rules, err = loadRules(opts.RulesFile); err != nil {
+			return
+		}
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	customHeadersDef, err = compileRules(rules)
+
+	return
+}
+
+// awsConfig builds the AWS client config out of the options, using the given credentials.
+func awsConfig(opts *options, creds *credentials.Credentials) *aws.Config {
+	retries := 2
+	awsCfg := &aws.Config{
+		Credentials:      creds,
+		Region:           &opts.Region,
+		MaxRetries:       &retries,
+		S3ForcePathStyle: &opts.ForcePathStyle,
+		DisableSSL:       &opts.DisableSSL,
+	}
+	if opts.Endpoint != "" {
+		awsCfg.Endpoint = &opts.Endpoint
+	}
+
+	return awsCfg
+}
+
 func initAWSClient() {
 	creds := credentials.NewChainCredentials(
 		[]credentials.Provider{
@@ -105,12 +208,7 @@ func initAWSClient() {
 			&credentials.EnvProvider{},
 		})
 
-	retries := 2
-	awsCfg := &aws.Config{
-		Credentials: creds,
-		Region:      &opts.Region,
-		MaxRetries:  &retries,
-	}
+	awsCfg := awsConfig(opts, creds)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -127,7 +225,7 @@ func initAWSClient() {
 }
 
 func abort(msg error) {
-	say(msg.Error())
+	logger.Error(msg.Error())
 	os.Exit(SetupFailed)
 }
 
@@ -147,7 +245,12 @@ func init() {
 			abort(err)
 		}
 	}
+	initLogger(opts)
+	if err := initHeaderRules(opts); err != nil {
+		abort(err)
+	}
 	appEnv = "production"
-	say = loggerGen()
-	initAWSClient()
+	if opts.Target == "" {
+		initAWSClient()
+	}
 }
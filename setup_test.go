@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"log/slog"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -26,6 +29,25 @@ func TestValidateCmdLineFlags(t *testing.T) {
 	if err := validateCmdLineFlags(opts1); err == nil {
 		t.Error("Expected to fail validation")
 	}
+
+	opts1 = &options{BucketName: "example_bucket", Source: "test/bogus", CacheFile: "test/.go3up.txt", Mappings: []mapping{{Source: "test/output"}}}
+	if err := validateCmdLineFlags(opts1); err != nil {
+		t.Error("Expected the Source to be ignored when mappings are given, got", err)
+	}
+	opts1.Mappings[0].Source = "test/bogus"
+	if err := validateCmdLineFlags(opts1); err == nil {
+		t.Error("Expected a missing mapping source to fail validation")
+	}
+
+	opts1 = &options{BucketName: "example_bucket", Source: "test/output", CacheFile: "test/.go3up.txt", Exclude: []string{"[abc"}}
+	if err := validateCmdLineFlags(opts1); err == nil || !strings.Contains(err.Error(), "[abc") {
+		t.Error("Expected invalid exclude patterns to fail validation, got", err)
+	}
+
+	opts1 = &options{BucketName: "example_bucket", Source: "test/output", CacheFile: "test/.go3up.txt", CompressMinSavings: 101}
+	if err := validateCmdLineFlags(opts1); err == nil {
+		t.Error("Expected compression savings over 100% to fail validation")
+	}
 }
 
 func TestValidateCmdLineFlag(t *testing.T) {
@@ -44,6 +66,48 @@ func TestValidateCmdLineFlag(t *testing.T) {
 	if err := validateCmdLineFlag("Bucket Name", ""); err == nil {
 		t.Error("Expected foobar bucket name to fail validation")
 	}
+
+	if err := validateCmdLineFlag("Log format", "yaml"); err == nil {
+		t.Error("Expected yaml log format to fail validation")
+	}
+
+	if err := validateCmdLineFlag("Plan format", "json"); err != nil {
+		t.Error("Expected json plan format to pass validation")
+	}
+
+	if err := validateCmdLineFlag("Plan format", "yaml"); err == nil {
+		t.Error("Expected yaml plan format to fail validation")
+	}
+}
+
+func TestInitHeaderRules(t *testing.T) {
+	defaults := customHeadersDef
+	defer func() { customHeadersDef = defaults }()
+
+	if err := initHeaderRules(&options{}); err != nil || len(customHeadersDef) != len(defaults) {
+		t.Fatal("Expected default rules to be kept when none are given, got", err)
+	}
+
+	opts1 := &options{Rules: []headerRule{{Pattern: "\\.txt$", CacheControl: "no-cache"}}}
+	if err := initHeaderRules(opts1); err != nil {
+		t.Fatal("Expected rules to be valid, got", err)
+	}
+	if hdrs := newSourceFile("barbaz.txt").hdrs; hdrs[CacheControl] != "no-cache" {
+		t.Error("Expected config rules to be used, got", hdrs)
+	}
+
+	opts1.RulesFile = "test/rules.json"
+	if err := initHeaderRules(opts1); err != nil {
+		t.Fatal("Expected rules file to be valid, got", err)
+	}
+	if hdrs := newSourceFile("barbaz.txt").hdrs; hdrs[CacheControl] != "" {
+		t.Error("Expected rules file to take precedence over config rules, got", hdrs)
+	}
+
+	opts1.RulesFile, opts1.Rules = "", []headerRule{{Pattern: "("}}
+	if err := initHeaderRules(opts1); err == nil {
+		t.Error("Expected invalid rules to fail")
+	}
 }
 
 func fakeUploaderGen(opts ...int) (fn uploader, out *([]*sourceFile)) {
@@ -53,7 +117,7 @@ func fakeUploaderGen(opts ...int) (fn uploader, out *([]*sourceFile)) {
 	}
 
 	out = &[]*sourceFile{}
-	fn = func(src *sourceFile) (err error) {
+	fn = func(_ context.Context, src *sourceFile) (err error) {
 		m.Lock()
 		*out = append(*out, src)
 		m.Unlock()
@@ -80,12 +144,6 @@ func init() {
 	opts.Source = "test/output"
 	opts.CacheFile = "test/.go3up.txt"
 	appEnv = "test"
-	fakeBuffer := &bytes.Buffer{}
-	sayLock := &sync.Mutex{}
-	sayFn := loggerGen(fakeBuffer)
-	say = func(msg ...string) {
-		sayLock.Lock()
-		defer sayLock.Unlock()
-		sayFn(msg...)
-	}
+	fakeBuffer = &bytes.Buffer{}
+	logger = newLogger(fakeBuffer, logHuman, slog.LevelInfo)
 }
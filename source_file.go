@@ -1,22 +1,44 @@
 package main
 
 import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
 	"mime"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Headers
 const (
-	ContentEncoding = "Content-Encoding"
-	CacheControl    = "Cache-Control"
-	ContentType     = "Content-Type"
+	ContentEncoding    = "Content-Encoding"
+	CacheControl       = "Cache-Control"
+	ContentType        = "Content-Type"
+	ContentDisposition = "Content-Disposition"
+	ContentLanguage    = "Content-Language"
 	// pseudo headers
 	Encryption = "EncryptionON"
 )
 
+// Actions
+const (
+	actionUpload = "upload"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+var actionsDone = map[string]string{
+	actionUpload: "Uploaded",
+	actionUpdate: "Updated",
+	actionDelete: "Deleted",
+}
+
 var sse = "AES256"
 
 type headers map[string]string
@@ -24,14 +46,31 @@ type headers map[string]string
 type pathToHeaders struct {
 	pathPattern *regexp.Regexp
 	headers
+	compression
+}
+
+// compression holds the compression settings of a pathToHeaders rule.
+type compression struct {
+	level    int      // compression level, for the Content-Encoding and the variants.
+	variants []string // encodings of the precompressed variants to upload along with the file.
 }
 
 type sourceFile struct {
 	fname,
-	fpath string
+	fpath,
+	action,
+	hash string
 	hdrs     headers
-	gzip     bool
-	attempts int
+	encoding string
+	level    int
+	// path of the precompressed sibling (i.e. app.js.gz) to be uploaded instead of compressing the file.
+	precompressed string
+	// why the file is stored uncompressed, despite its rule (see storedSourceFile).
+	uncompressed string
+	deletes      []string
+	attempts     int
+	// size of the file and of its (possibly compressed) content, as read by the last body call.
+	size, stored int64
 	sync.Mutex
 }
 
@@ -54,21 +93,81 @@ func (h *headers) equal(other headers) bool {
 	return true
 }
 
+// newSourceFile returns the sourceFile of a key, with its headers set by the first matching rule.
+// Variant keys (see variantOf) get the headers of their original file, except for the Content-Encoding.
+// Compressed files reuse their precompressed sibling, if fresh (see freshSibling). Whether their
+// compression pays off is up to storedSourceFile.
 func newSourceFile(fname string) (sf *sourceFile) {
-	sf = &sourceFile{fname: fname, fpath: filepath.Join(opts.Source, fname)}
+	if orig, enc, ok := variantOf(fname); ok {
+		sf = newSourceFile(orig)
+		sf.fname, sf.hdrs[ContentEncoding], sf.encoding = fname, enc, enc
+		sf.precompressed = freshSibling(sf.fpath, sf.encoding)
+		return
+	}
+
+	sf = &sourceFile{fname: fname, fpath: localPath(fname), action: actionUpload}
 	sf.hdrs = headers{ContentType: mime.TypeByExtension(strings.ToLower(filepath.Ext(fname)))}
 
-	for _, hdrs := range customHeadersDef {
-		if hdrs.pathPattern.MatchString(fname) {
-			sf.hdrs.merge(hdrs.headers)
-			break
-		}
+	if rule := matchRule(fname); rule != nil {
+		sf.hdrs.merge(rule.headers)
+		sf.level = rule.level
+	}
+	if _, ok := encodings[sf.hdrs[ContentEncoding]]; ok {
+		sf.encoding = sf.hdrs[ContentEncoding]
 	}
-	sf.gzip = (sf.hdrs[ContentEncoding] == "gzip")
+	sf.precompressed = freshSibling(sf.fpath, sf.encoding)
 
 	return
 }
 
+// uncompress makes the file be stored as is, without Content-Encoding, for the given reason.
+// Variants stored as is make no sense, they are not stored at all (see workList).
+func (s *sourceFile) uncompress(reason string) {
+	delete(s.hdrs, ContentEncoding)
+	s.encoding, s.precompressed, s.uncompressed = "", "", reason
+}
+
+// isVariant tells whether the file is a precompressed variant of another one.
+func (s *sourceFile) isVariant() bool {
+	_, _, ok := variantOf(s.fname)
+
+	return ok
+}
+
+// matchRule returns the first rule matching the key, if any.
+func matchRule(fname string) *pathToHeaders {
+	for i, rule := range customHeadersDef {
+		if rule.pathPattern.MatchString(fname) {
+			return &customHeadersDef[i]
+		}
+	}
+
+	return nil
+}
+
+// newDeleteBatch returns a sourceFile standing for a batch of remote files to be deleted.
+func newDeleteBatch(fnames []string) *sourceFile {
+	return &sourceFile{fname: fnames[0], action: actionDelete, deletes: fnames}
+}
+
+// keys returns the (remote) file names the sourceFile is responsible for.
+func (s *sourceFile) keys() []string {
+	if s.action == actionDelete {
+		return s.deletes
+	}
+
+	return []string{s.fname}
+}
+
+// label returns a short, human readable, description of the sourceFile.
+func (s *sourceFile) label() string {
+	if s.action == actionDelete && len(s.deletes) > 1 {
+		return fmt.Sprintf("%s (+%d more)", s.deletes[0], len(s.deletes)-1)
+	}
+
+	return s.fname
+}
+
 func (s *sourceFile) getHeader(hdr string) *string {
 	if hdr == Encryption {
 		if opts.Encrypt {
@@ -83,6 +182,121 @@ func (s *sourceFile) getHeader(hdr string) *string {
 	return nil
 }
 
+// errFileChanged is the error of a file changed while being read (i.e. by the site generator).
+var errFileChanged = errors.New("file changed while being read")
+
+// bodyError is the error of compressing a file content, while reading it. Only the transient ones
+// (the file changed while being read) are recoverable, failing to read the file (i.e. EISDIR, EACCES
+// or EIO) is not.
+type bodyError struct {
+	fpath string
+	err   error
+}
+
+func (e *bodyError) Error() string {
+	return fmt.Sprintf("compressing %s failed: %v", e.fpath, e.err)
+}
+
+func (e *bodyError) Unwrap() error {
+	return e.err
+}
+
+func (e *bodyError) transient() bool {
+	return errors.Is(e.err, errFileChanged)
+}
+
+// body returns the content of the file, as it is to be stored (compressed with its encoding, if any).
+func (s *sourceFile) body() (io.ReadCloser, error) {
+	if s.precompressed != "" {
+		if fi, err := os.Stat(s.fpath); err == nil {
+			s.size = fi.Size()
+		}
+		f, err := os.Open(s.precompressed)
+		if err != nil {
+			return nil, err
+		}
+		atomic.StoreInt64(&s.stored, 0)
+
+		return countingReader{f, &s.stored}, nil
+	}
+
+	f, err := os.Open(s.fpath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		s.size = fi.Size()
+	}
+	atomic.StoreInt64(&s.stored, 0)
+	if s.encoding == "" {
+		return countingReader{f, &s.stored}, nil
+	}
+
+	// The content is compressed on the fly, through a pipe: any compression failure is passed on
+	// to the reader (as a bodyError), while closing the reader early makes the writes fail, so that
+	// the goroutine never outlives the upload.
+	r, w := io.Pipe()
+	go func() {
+		defer func() {
+			_ = f.Close()
+		}()
+		wz, err := encodings[s.encoding].newWriter(w, s.level)
+		if err == nil {
+			_, err = io.Copy(wz, f)
+			if err2 := wz.Close(); err == nil {
+				err = err2
+			}
+		}
+		if err == nil && fi != nil {
+			if now, err2 := f.Stat(); err2 == nil && (now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime())) {
+				err = errFileChanged
+			}
+		}
+		if err != nil && err != io.ErrClosedPipe {
+			err = &bodyError{s.fpath, err}
+		}
+		_ = w.CloseWithError(err)
+	}()
+
+	return countingReader{r, &s.stored}, nil
+}
+
+// storedSize returns the size of the content read by the last body call.
+func (s *sourceFile) storedSize() int64 {
+	return atomic.LoadInt64(&s.stored)
+}
+
+// metadata returns the user metadata to be stored along with the file: the md5 of its original
+// (uncompressed) content, which the ETag cannot provide for compressed files.
+func (s *sourceFile) metadata() map[string]*string {
+	if s.hash == "" {
+		return nil
+	}
+
+	return map[string]*string{metaHash: &s.hash}
+}
+
+// fingerprint returns a short hash of the headers the file is uploaded with (including the
+// encryption setting), used for detecting header changes of otherwise unchanged files.
+func (s *sourceFile) fingerprint() string {
+	keys := make([]string, 0, len(s.hdrs))
+	for k := range s.hdrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hash := md5.New()
+	for _, k := range keys {
+		_, _ = io.WriteString(hash, k+"="+s.hdrs[k]+"\n")
+	}
+	if sse := s.getHeader(Encryption); sse != nil {
+		_, _ = io.WriteString(hash, Encryption+"="+*sse+"\n")
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))[:8]
+}
+
 func (s *sourceFile) recordAttempt() {
 	s.Lock()
 	s.attempts++
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
 func TestHeadersMerge(t *testing.T) {
@@ -46,7 +56,7 @@ func TestNewSourceFile(t *testing.T) {
 		t.Errorf("Expected hdrs to be set to %v got %v", expectedHdrs, sf.hdrs)
 	}
 
-	if !sf.gzip {
+	if sf.encoding != "gzip" {
 		t.Error("Expected .html files to be compressed")
 	}
 
@@ -65,6 +75,57 @@ func TestNewSourceFile(t *testing.T) {
 	}
 }
 
+func TestNewDeleteBatch(t *testing.T) {
+	sf := newDeleteBatch([]string{"foo.html", "bar.html", "baz.html"})
+
+	if sf.action != actionDelete {
+		t.Errorf("Expected action to be %s got %s", actionDelete, sf.action)
+	}
+
+	if keys := strings.Join(sf.keys(), ":"); keys != "foo.html:bar.html:baz.html" {
+		t.Error("Expected keys to hold the whole batch, got", keys)
+	}
+
+	if label := sf.label(); label != "foo.html (+2 more)" {
+		t.Error("Expected label to summarize the batch, got", label)
+	}
+
+	if keys := newSourceFile("foobar.html").keys(); len(keys) != 1 || keys[0] != "foobar.html" {
+		t.Error("Expected keys of an upload to hold just its name, got", keys)
+	}
+}
+
+func TestSourceFileMetadata(t *testing.T) {
+	sf := newSourceFile("foobar.html")
+	if meta := sf.metadata(); meta != nil {
+		t.Error("Expected no metadata for a file without hash, got", meta)
+	}
+
+	sf.hash = "01677e4c0ae5468b9b8b823487f14524"
+	if meta := sf.metadata(); len(meta) != 1 || meta[metaHash] == nil || *meta[metaHash] != sf.hash {
+		t.Errorf("Expected metadata to hold %s under %s, got %v", sf.hash, metaHash, meta)
+	}
+}
+
+func TestSourceFileFingerprint(t *testing.T) {
+	sf1, sf2 := newSourceFile("foobar.html"), newSourceFile("foobar.html")
+	if sf1.fingerprint() != sf2.fingerprint() {
+		t.Error("Expected the fingerprint to be stable")
+	}
+
+	fp := sf1.fingerprint()
+	if sf2.hdrs[CacheControl] = "max-age=60"; sf2.fingerprint() == fp {
+		t.Error("Expected the fingerprint to change along with the headers")
+	}
+
+	encrypt := opts.Encrypt
+	opts.Encrypt = !encrypt
+	if sf1.fingerprint() == fp {
+		t.Error("Expected the fingerprint to change along with the encryption setting")
+	}
+	opts.Encrypt = encrypt
+}
+
 func TestSourceFileAttempted(t *testing.T) {
 	fname := "foobar.html"
 	sf := newSourceFile(fname)
@@ -112,3 +173,77 @@ func TestSourceFileRetriable(t *testing.T) {
 		t.Fatal("A source file with more than maxTries attempts should NOT be retriable")
 	}
 }
+
+func TestSourceFileBodyError(t *testing.T) {
+	sf := newSourceFile("foobar.html")
+	sf.fpath = "test/output" // a folder, which can be opened but not read.
+
+	body, err := sf.body()
+	if err != nil {
+		t.Fatal("Expected body to succeed, got", err)
+	}
+	_, err = ioutil.ReadAll(body)
+	_ = body.Close()
+	if _, ok := err.(*bodyError); !ok {
+		t.Fatal("Expected the compression failure to be passed on, got", err)
+	}
+	if isRecoverable(err) || isRecoverable(awserr.New("ReadRequestBody", "read upload data failed", err)) {
+		t.Error("Expected the read failure to be rejected rather than retried, got", err)
+	}
+}
+
+func TestSourceFileBodyChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the temp folder:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Random content does not compress, so the compression blocks on the pipe long before the
+	// whole file is read.
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	sf := newSourceFile("foobar.html")
+	sf.fpath = filepath.Join(dir, "foobar.html")
+	if err = ioutil.WriteFile(sf.fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := sf.body()
+	if err != nil {
+		t.Fatal("Expected body to succeed, got", err)
+	}
+	f, err := os.OpenFile(sf.fpath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("changed"))
+	_ = f.Close()
+	_, err = ioutil.ReadAll(body)
+	_ = body.Close()
+
+	if !errors.Is(err, errFileChanged) {
+		t.Fatal("Expected the file change to be detected, got", err)
+	}
+	if !isRecoverable(err) || !isRecoverable(awserr.New("ReadRequestBody", "read upload data failed", err)) {
+		t.Error("Expected the file change to be recoverable, got", err)
+	}
+}
+
+func TestSourceFileBodyClosed(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		body, err := newSourceFile("foobar.html").body()
+		if err != nil {
+			t.Fatal("Expected body to succeed, got", err)
+		}
+		_ = body.Close()
+	}
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Expected the compression goroutines to end once the body is closed, got %d more", n-goroutines)
+	}
+}
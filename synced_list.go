@@ -7,8 +7,8 @@ type syncedlist struct {
 	sync.Mutex
 }
 
-func (sl *syncedlist) add(item string) {
+func (sl *syncedlist) add(items ...string) {
 	sl.Lock()
-	sl.list = append(sl.list, item)
+	sl.list = append(sl.list, items...)
 	sl.Unlock()
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 // S3 errors that we will retry.
@@ -16,21 +20,100 @@ var recoverableErrorsSuffixes = []string{
 	"TLS handshake timeout",
 }
 
-func loggerGen(buffers ...*bytes.Buffer) func(msgs ...string) {
-	return func(msgs ...string) {
-		m := msg(msgs...)
+// copySource returns the (URL encoded) copy source of a key in a bucket, as expected by CopyObject.
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		// S3 would decode a "+" as a space.
+		segments[i] = strings.Replace(url.PathEscape(segment), "+", "%2B", -1)
+	}
+
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// countingReader counts the bytes read through it, into n.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+
+	return
+}
+
+// countingWriter discards whatever is written to it, only counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+
+	return len(p), nil
+}
+
+// percent returns n as a percentage of total (100, for an empty total).
+func percent(n, total int64) int {
+	if total == 0 {
+		return 100
+	}
+
+	return int(n * 100 / total)
+}
+
+// tempPrefix is the name prefix of the temporary files written by writeFileAtomic.
+const tempPrefix = ".go3up-tmp-"
 
-		if len(buffers) > 0 {
-			_, _ = buffers[0].WriteString(m)
-			return
+// defaultFileMode is the mode of the files written by writeFileAtomic (ioutil.TempFile creates them
+// readable by their owner only, which would leave i.e. the files deployed to a local directory
+// unreadable by the web server).
+const defaultFileMode os.FileMode = 0644
+
+// writeFileAtomic writes a file by means of the write func, via a temporary file in the
+// same folder which is then renamed, so that readers never see a partially written file.
+// The file keeps the mode of the one it replaces, if any, or else gets the defaultFileMode.
+func writeFileAtomic(fname string, write func(io.Writer) error) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(fname), tempPrefix)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
 		}
+	}()
 
-		fmt.Print(m)
+	if err = write(f); err != nil {
+		return
 	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	mode := defaultFileMode
+	if fi, err := os.Stat(fname); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = os.Chmod(f.Name(), mode); err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), fname)
 }
 
-// isRecoverable verifies if the error given is in recoverableErrorsSuffixes list.
+// isRecoverable verifies if the error given is in recoverableErrorsSuffixes list or is caused
+// by a transient bodyError (possibly wrapped, i.e. by the AWS SDK).
 func isRecoverable(err error) (yes bool) {
+	for e := err; e != nil; e = cause(e) {
+		if be, ok := e.(*bodyError); ok {
+			return be.transient()
+		}
+	}
+
 	for _, errSuffix := range recoverableErrorsSuffixes {
 		if strings.HasSuffix(err.Error(), errSuffix) {
 			return true
@@ -40,23 +123,14 @@ func isRecoverable(err error) (yes bool) {
 	return
 }
 
-// msg accepts 3 messages, corresponding to (in order): verbose, normal, quiet,
-// and returns one of them based on the opts.verbose and opts.quiet flags.
-//
-// If the message for a respective state is blank, nothing will be printed,
-// except if message for normal is missing. In that case, the verbose message
-// will be printed if available.
-func msg(msgs ...string) string {
-	if opts.verbose && len(msgs) > 0 {
-		return msgs[0] + "\n"
-	} else if opts.quiet {
-		if len(msgs) > 2 {
-			return msgs[2]
-		}
-		return ""
-	} else if len(msgs) > 1 {
-		return msgs[1]
+// cause returns the error wrapped by err, either the standard way or the AWS SDK one, if any.
+func cause(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ OrigErr() error }:
+		return e.OrigErr()
 	}
 
-	return ""
+	return nil
 }
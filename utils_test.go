@@ -2,6 +2,10 @@ package main
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -15,37 +19,41 @@ func TestIsRecoverable(t *testing.T) {
 	}
 }
 
-func TestMsg(t *testing.T) {
-	actual := msg()
-	if expected := ""; actual != expected {
-		t.Error("Expected a blank message, got", actual)
+func TestCopySource(t *testing.T) {
+	if actual := copySource("example_bucket", "docs/a b+c.html"); actual != "example_bucket/docs/a%20b%2Bc.html" {
+		t.Error("Expected the key to be URL encoded, got", actual)
 	}
+}
 
-	verbose := opts.verbose
-	opts.verbose = true
-	if actual := msg("Foo", "bar", "baz"); actual != "Foo\n" {
-		t.Error("Expected Foo\\n got", actual)
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go3up")
+	if err != nil {
+		t.Fatal("Failed to create the temp folder:", err)
 	}
+	defer os.RemoveAll(dir)
 
-	quiet := opts.quiet
-	opts.quiet = true
-	opts.verbose = false
-	if actual := msg("Foo", "bar", "baz"); actual != "baz" {
-		t.Error("Expected baz got", actual)
+	fname := filepath.Join(dir, "file.txt")
+	write := func(w io.Writer) error {
+		_, err := io.WriteString(w, "content")
+		return err
 	}
-	if actual := msg(); actual != "" {
-		t.Error("Expected message to be blank, got", actual)
+	if err = writeFileAtomic(fname, write); err != nil {
+		t.Fatal("Expected the file to be written, got", err)
 	}
-
-	opts.quiet = false
-	if actual := msg("Foo", "bar", "baz"); actual != "bar" {
-		t.Error("Expected bar got", actual)
+	if fi, _ := os.Stat(fname); fi == nil || fi.Mode().Perm() != defaultFileMode {
+		t.Errorf("Expected the file to be created with mode %v, got %v", defaultFileMode, fi)
 	}
-
-	if actual := msg("Foo"); actual != "" {
-		t.Error("Expected blank message got", actual)
+	if data, _ := ioutil.ReadFile(fname); string(data) != "content" {
+		t.Error("Expected the content to be written, got", string(data))
 	}
 
-	opts.verbose = verbose
-	opts.quiet = quiet
+	if err = os.Chmod(fname, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFileAtomic(fname, write); err != nil {
+		t.Fatal("Expected the file to be rewritten, got", err)
+	}
+	if fi, _ := os.Stat(fname); fi == nil || fi.Mode().Perm() != 0600 {
+		t.Error("Expected the file to keep its mode, got", fi)
+	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/alexaandru/utils"
+)
+
+// variantOf tells whether the key is a precompressed variant (i.e. foo.html.br) of another file,
+// as set by the variants of the rule matching the latter, returning its key and the variant encoding.
+// Variants of missing files are not variants (i.e. foo.html.br is uploaded as is, without foo.html).
+func variantOf(key string) (orig, enc string, ok bool) {
+	for name, e := range encodings {
+		if !strings.HasSuffix(key, e.ext) {
+			continue
+		}
+
+		orig = strings.TrimSuffix(key, e.ext)
+		if rule := matchRule(orig); rule != nil && hasVariant(rule, name) {
+			if _, err := os.Stat(localPath(orig)); err == nil {
+				return orig, name, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+func hasVariant(rule *pathToHeaders, enc string) bool {
+	for _, v := range rule.variants {
+		if v == enc {
+			return true
+		}
+	}
+
+	return false
+}
+
+// freshSibling returns the path of the precompressed sibling of the file (i.e. app.js.gz, as produced
+// by a site generator) for the given encoding, if there is one not older than the file itself.
+func freshSibling(fpath, enc string) string {
+	e, ok := encodings[enc]
+	if !ok {
+		return ""
+	}
+
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return ""
+	}
+	sibling, err := os.Stat(fpath + e.ext)
+	if err != nil || sibling.IsDir() || sibling.ModTime().Before(fi.ModTime()) {
+		return ""
+	}
+
+	return fpath + e.ext
+}
+
+// addVariants adds the precompressed variants of the current files to the list, with the same hash
+// as their original file (their headers fingerprint sets them apart), so that they get cached,
+// uploaded and deleted along with it. It also drops the precompressed siblings of the files to be
+// compressed (i.e. app.js.gz, for a gzip rule), which are never uploaded on their own: fresh ones are
+// uploaded as the file content (see freshSibling), stale ones are ignored. Likewise, local files named
+// as variants become variants: fresh ones are reused as such, stale ones are ignored.
+func addVariants(current utils.FileHashes) {
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		rule := matchRule(key)
+		if rule == nil {
+			continue
+		}
+
+		if enc := rule.headers[ContentEncoding]; encodings[enc].ext != "" {
+			sibling := key + encodings[enc].ext
+			if _, ok := current[sibling]; ok && freshSibling(localPath(key), enc) == "" {
+				logger.Warn("Ignoring stale precompressed file", "key", sibling)
+			}
+			delete(current, sibling)
+		}
+		for _, enc := range rule.variants {
+			variant := key + encodings[enc].ext
+			if _, ok := current[variant]; ok && freshSibling(localPath(key), enc) == "" {
+				logger.Warn("Ignoring stale precompressed file", "key", variant)
+			}
+			current[variant] = current[key]
+		}
+	}
+}
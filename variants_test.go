@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexaandru/utils"
+)
+
+// withVariants sets up rules with the given variants for the .html files, and a source folder
+// holding the given files, each modified at the given time.
+func withVariants(t *testing.T, files map[string]time.Time, variants ...string) {
+	defaults, source := customHeadersDef, opts.Source
+	t.Cleanup(func() { customHeadersDef, opts.Source = defaults, source })
+
+	customHeadersDef = []pathToHeaders{
+		{r("\\.html$"), headers{CacheControl: "max-age=3600"}, compression{9, variants}},
+		{r("\\.js$"), headers{ContentEncoding: "gzip"}, compression{}},
+		{r("\\.txt$"), headers{CacheControl: "no-cache"}, compression{}},
+	}
+
+	opts.Source = t.TempDir()
+	for fname, mtime := range files {
+		fpath := filepath.Join(opts.Source, fname)
+		if err := ioutil.WriteFile(fpath, []byte(fname), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVariantOf(t *testing.T) {
+	now := time.Now()
+	withVariants(t, map[string]time.Time{"foo.html": now, "foo.txt": now}, "br", "gzip")
+
+	tests := map[string][2]string{
+		"foo.html.br":  {"foo.html", "br"},
+		"foo.html.gz":  {"foo.html", "gzip"},
+		"foo.html.zst": {},
+		"bar.html.gz":  {},
+		"foo.txt.gz":   {},
+		"foo.html":     {},
+		"foo.html.gz~": {},
+	}
+	for key, expected := range tests {
+		orig, enc, ok := variantOf(key)
+		if orig != expected[0] || enc != expected[1] || ok != (expected[0] != "") {
+			t.Errorf("Expected %s to be a variant of %q (%q), got %q (%q) %v", key, expected[0], expected[1], orig, enc, ok)
+		}
+	}
+}
+
+func TestNewSourceFileVariant(t *testing.T) {
+	withVariants(t, map[string]time.Time{"foo.html": time.Now()}, "br")
+
+	sf := newSourceFile("foo.html.br")
+	expectedHdrs := headers{ContentType: "text/html; charset=utf-8", ContentEncoding: "br", CacheControl: "max-age=3600"}
+	if !sf.hdrs.equal(expectedHdrs) {
+		t.Errorf("Expected hdrs to be set to %v got %v", expectedHdrs, sf.hdrs)
+	}
+	if sf.fname != "foo.html.br" || sf.fpath != localPath("foo.html") {
+		t.Error("Expected the variant to be read from the original file, got", sf.fpath)
+	}
+	if sf.encoding != "br" || sf.level != 9 || sf.precompressed != "" {
+		t.Errorf("Expected the variant to be compressed with br at level 9, got %q at %d", sf.encoding, sf.level)
+	}
+
+	if orig := newSourceFile("foo.html"); orig.encoding != "" || orig.hdrs[ContentEncoding] != "" {
+		t.Error("Expected the original to be left uncompressed, got", orig.hdrs)
+	}
+}
+
+func TestFreshSibling(t *testing.T) {
+	now := time.Now()
+	withVariants(t, map[string]time.Time{
+		"app.js": now, "app.js.gz": now.Add(time.Second), "app.js.br": now.Add(-time.Second), "app.js.zst": now,
+	})
+	fpath := localPath("app.js")
+
+	tests := map[string]string{"gzip": fpath + ".gz", "br": "", "zstd": fpath + ".zst", "": "", identity: ""}
+	for enc, expected := range tests {
+		if actual := freshSibling(fpath, enc); actual != expected {
+			t.Errorf("Expected the %q sibling to be %q, got %q", enc, expected, actual)
+		}
+	}
+}
+
+func TestNewSourceFilePrecompressed(t *testing.T) {
+	now := time.Now()
+	withVariants(t, map[string]time.Time{"app.js": now, "app.js.gz": now.Add(time.Second)})
+
+	sf := newSourceFile("app.js")
+	if sf.precompressed != localPath("app.js.gz") || sf.hdrs[ContentEncoding] != "gzip" {
+		t.Fatal("Expected the precompressed sibling to be reused, got", sf.precompressed, sf.hdrs)
+	}
+
+	body, err := sf.body()
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	defer func() { _ = body.Close() }()
+	data, err := ioutil.ReadAll(body)
+	if err != nil || string(data) != "app.js.gz" {
+		t.Errorf("Expected the sibling content to be uploaded as is, got %q (%v)", data, err)
+	}
+	if sf.size != int64(len("app.js")) || sf.storedSize() != int64(len("app.js.gz")) {
+		t.Errorf("Expected sizes of the file and of the sibling, got %d and %d", sf.size, sf.storedSize())
+	}
+}
+
+func TestAddVariants(t *testing.T) {
+	now := time.Now()
+	withVariants(t, map[string]time.Time{
+		"foo.html": now, "foo.html.gz": now.Add(time.Second), "bar.html": now, "bar.html.gz": now.Add(-time.Second),
+		"app.js": now, "app.js.gz": now.Add(time.Second), "lib.js": now, "lib.js.gz": now.Add(-time.Second),
+	}, "br", "gzip")
+
+	current := utils.FileHashes{
+		"foo.html": "x", "foo.html.gz": "g", "bar.html": "y", "bar.html.gz": "s",
+		"app.js": "a", "app.js.gz": "z", "lib.js": "l", "lib.js.gz": "s", "baz.txt": "t",
+	}
+	addVariants(current)
+	expected := utils.FileHashes{
+		"foo.html": "x", "foo.html.br": "x", "foo.html.gz": "x", "bar.html": "y", "bar.html.br": "y", "bar.html.gz": "y",
+		"app.js": "a", "lib.js": "l", "baz.txt": "t",
+	}
+	if len(current) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, current)
+	}
+	for key, hash := range expected {
+		if current[key] != hash {
+			t.Errorf("Expected %s to hash to %q, got %q", key, hash, current[key])
+		}
+	}
+
+	if sf := newSourceFile("foo.html.gz"); sf.precompressed != localPath("foo.html.gz") {
+		t.Error("Expected the fresh variant to be reused, got", sf.precompressed)
+	}
+	if sf := newSourceFile("bar.html.gz"); sf.precompressed != "" || sf.fpath != localPath("bar.html") {
+		t.Error("Expected the stale variant to be compressed from the original, got", sf.precompressed)
+	}
+}
+
+func TestWorkListVariantSkipCompression(t *testing.T) {
+	minSize := opts.CompressMinSize
+	defer func() { opts.CompressMinSize = minSize }()
+
+	withVariants(t, map[string]time.Time{"foo.html": time.Now()}, "br")
+	opts.CompressMinSize = 100
+
+	current := utils.FileHashes{"foo.html": "x"}
+	addVariants(current)
+	if len(current) != 2 || current["foo.html.br"] != "x" {
+		t.Fatal("Expected the variant to be listed, got", current)
+	}
+
+	work := workList(current, utils.FileHashes{}, []string{"foo.html", "foo.html.br"}, nil, nil)
+	if len(work) != 2 || work[0].action != actionUpload || work[0].hdrs[ContentEncoding] != "" {
+		t.Fatal("Expected foo.html to be uploaded as is, got", work)
+	}
+	if v := work[1]; v.action != actionDelete || len(v.deletes) != 1 || v.deletes[0] != "foo.html.br" || v.uncompressed == "" {
+		t.Error("Expected the variant which does not pay off to be deleted, got", v)
+	}
+
+	r := newRunReport()
+	r.done(work[1])
+	if len(r.Uncompressed) != 1 || r.Uncompressed[0].Key != "foo.html.br" {
+		t.Error("Expected the variant to be reported, got", r.Uncompressed)
+	}
+
+	old := fingerprinted(current, utils.FileHashes{})
+	if _, _, enc := splitCacheEntry(old["foo.html.br"]); enc != "" {
+		t.Error("Expected the variant to be cached as not stored, got", old["foo.html.br"])
+	}
+	if diff, updates := cacheDiff(current, old); len(diff)+len(updates) != 0 {
+		t.Error("Expected the variant not to be reconsidered until changed, got", diff, updates)
+	}
+	customHeadersDef[0].headers[CacheControl] = "no-cache"
+	if work = workList(current, old, nil, []string{"foo.html.br"}, nil); len(work) != 0 {
+		t.Error("Expected the variant to need no headers update, got", work)
+	}
+}